@@ -15,10 +15,15 @@ func main() {
 	set := flag.NewFlagSet("app", flag.ExitOnError)
 	promURL := set.String("prom-endpoint", "", "Prometheus API endpoint for the server")
 	serverRootCACert := set.String("server-root-ca-cert", "", "Optional path to root server CA cert")
-	clientCert := set.String("client-cert", "", "Required path to client cert")
-	clientKey := set.String("client-key", "", "Required path to client key")
+	clientCert := set.String("client-cert", "", "Path to client cert for mTLS")
+	clientKey := set.String("client-key", "", "Path to client key for mTLS")
 	serverName := set.String("server-name", "", "Server name to use for verifying the server's certificate")
 	insecureSkipVerify := set.Bool("insecure-skip-verify", false, "Skip verification of the server's certificate and host name")
+	bearerTokenFile := set.String("bearer-token-file", "", "Path to a bearer token such as an API key, re-read on every request")
+	bearerTokenEnv := set.String("bearer-token-env", "", "Environment variable holding a bearer token such as an API key")
+	basicAuthUsername := set.String("basic-auth-username", "", "Username for basic auth")
+	basicAuthPasswordFile := set.String("basic-auth-password-file", "", "Path to the basic auth password, re-read on every request")
+	basicAuthPasswordEnv := set.String("basic-auth-password-env", "", "Environment variable holding the basic auth password")
 	matrixPrefix := set.String("matrix-prefix", "temporal_cloud_", "Prefix of the metrics to be queried and send to Datadog")
 	stepDuration := set.Int("step-duration-seconds", 60, "The step between metrics")
 	queryInterval := set.Int("query-interval-seconds", 600, "Interval between each Prometheus query")
@@ -26,8 +31,6 @@ func main() {
 
 	if err := set.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("failed parsing args: %s", err)
-	} else if *clientCert == "" || *clientKey == "" {
-		log.Fatalf("-client-cert and -client-key are required")
 	}
 
 	datadogClient := datadog.NewAPIClient()
@@ -40,6 +43,12 @@ func main() {
 			ClientKey:          *clientKey,
 			ServerName:         *serverName,
 			InsecureSkipVerify: *insecureSkipVerify,
+
+			BearerTokenFile:       *bearerTokenFile,
+			BearerTokenEnv:        *bearerTokenEnv,
+			BasicAuthUsername:     *basicAuthUsername,
+			BasicAuthPasswordFile: *basicAuthPasswordFile,
+			BasicAuthPasswordEnv:  *basicAuthPasswordEnv,
 		},
 	)
 	if err != nil {
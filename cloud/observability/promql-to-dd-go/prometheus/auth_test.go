@@ -0,0 +1,66 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRoundTripper(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("api-key\n"), 0o600))
+	t.Setenv("TEST_PROM_PASSWORD", "hunter2")
+
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+	defer srv.Close()
+
+	testCases := []struct {
+		name     string
+		cfg      Config
+		wantErr  bool
+		wantAuth string
+	}{
+		{
+			name:     "bearer token from file",
+			cfg:      Config{BearerTokenFile: tokenFile},
+			wantAuth: "Bearer api-key",
+		},
+		{
+			name:     "basic auth from env",
+			cfg:      Config{BasicAuthUsername: "prometheus", BasicAuthPasswordEnv: "TEST_PROM_PASSWORD"},
+			wantAuth: "Basic cHJvbWV0aGV1czpodW50ZXIy",
+		},
+		{
+			name:    "no authentication",
+			cfg:     Config{},
+			wantErr: true,
+		},
+		{
+			name:    "bearer token and basic auth",
+			cfg:     Config{BearerTokenEnv: "TEST_PROM_PASSWORD", BasicAuthUsername: "prometheus", BasicAuthPasswordEnv: "TEST_PROM_PASSWORD"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt, err := NewRoundTripper(tc.cfg)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.wantAuth, got.Header.Get("Authorization"))
+		})
+	}
+}
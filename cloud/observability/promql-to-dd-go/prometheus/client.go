@@ -23,6 +23,8 @@ type (
 	}
 )
 
+// Config is how to reach and authenticate with the Prometheus API. At least one of mTLS, a
+// bearer token or basic auth must be set.
 type Config struct {
 	TargetHost         string
 	ServerRootCACert   string
@@ -30,22 +32,26 @@ type Config struct {
 	ClientKey          string
 	ServerName         string
 	InsecureSkipVerify bool
+
+	// BearerTokenFile or BearerTokenEnv holds a token sent as Authorization: Bearer, eg. a
+	// Temporal Cloud API key.
+	BearerTokenFile string
+	BearerTokenEnv  string
+	// BasicAuthUsername turns on basic auth, with the password held by BasicAuthPasswordFile
+	// or BasicAuthPasswordEnv.
+	BasicAuthUsername     string
+	BasicAuthPasswordFile string
+	BasicAuthPasswordEnv  string
 }
 
 func NewAPIClient(cfg Config) (*APIClient, error) {
-	tlsCfg, err := BuildTLSConfig(
-		cfg.ClientCert,
-		cfg.ClientKey,
-		cfg.ServerRootCACert,
-		cfg.ServerName,
-		cfg.InsecureSkipVerify,
-	)
+	rt, err := NewRoundTripper(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build tls config %w", err)
+		return nil, err
 	}
 
 	httpClient := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		Transport: rt,
 	}
 
 	client, err := NewHttpClient(cfg.TargetHost, httpClient)
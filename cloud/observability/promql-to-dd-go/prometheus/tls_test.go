@@ -0,0 +1,167 @@
+package prometheus
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTLSReload(t *testing.T) {
+	certFile := filepath.Join(t.TempDir(), "client.pem")
+	first := writeTestKeyPair(t, certFile, "client-1", time.Now().Add(time.Hour))
+
+	conf, err := BuildTLSConfig(certFile, certFile, "", "", false)
+	require.NoError(t, err)
+	cert, err := conf.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "client-1", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, first.Unix(), ClientCertExpiries()[certFile].Unix())
+
+	touch := func() {
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(certFile, later, later))
+	}
+
+	// a broken file keeps the previous key pair
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	touch()
+	cert, err = conf.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "client-1", cert.Leaf.Subject.CommonName)
+
+	second := writeTestKeyPair(t, certFile, "client-2", time.Now().Add(2*time.Hour))
+	touch()
+	cert, err = conf.GetClientCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "client-2", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, second.Unix(), ClientCertExpiries()[certFile].Unix())
+
+	_, err = BuildTLSConfig("missing.crt", "missing.key", "", "", false)
+	assert.Error(t, err)
+}
+
+func TestVerifyServerName(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{writeTestServerCert(t, caFile)}}
+	srv.StartTLS()
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	t.Setenv("TEST_PROM_TOKEN", "api-key")
+
+	testCases := []struct {
+		name       string
+		targetHost string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "endpoint IP in the SANs", targetHost: srv.URL + "/prometheus"},
+		{name: "endpoint IP missing from the SANs", targetHost: fmt.Sprintf("https://127.0.0.2:%d/prometheus", port), wantErr: true},
+		{name: "configured server name", targetHost: fmt.Sprintf("https://127.0.0.2:%d/prometheus", port), serverName: "localhost"},
+		{name: "configured server name missing from the SANs", targetHost: srv.URL, serverName: "prometheus.example.com", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt, err := NewRoundTripper(Config{
+				TargetHost:       tc.targetHost,
+				ServerRootCACert: caFile,
+				ServerName:       tc.serverName,
+				BearerTokenEnv:   "TEST_PROM_TOKEN",
+			})
+			require.NoError(t, err)
+			// always dial the test server, whatever the endpoint says
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// without a name, an IP address is not verified against anything, so it is refused
+	conf, err := BuildTLSConfig("", "", caFile, "", false)
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: conf}}).Get(srv.URL)
+	assert.ErrorContains(t, err, "no server name")
+}
+
+// writeTestServerCert writes a CA to caFile and returns a server key pair it signed, valid for
+// localhost and 127.0.0.1.
+func writeTestServerCert(t *testing.T, caFile string) tls.Certificate {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeTestKeyPair writes a self-signed cert for cn expiring at notAfter, followed by its key,
+// to file.
+func writeTestKeyPair(t *testing.T, file, cn string, notAfter time.Time) time.Time {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	out = append(out, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	require.NoError(t, os.WriteFile(file, out, 0o600))
+	return notAfter
+}
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV2"
 	"github.com/prometheus/common/model"
@@ -38,6 +39,22 @@ func PromCountToDatadogRate(name string, matrix model.Matrix) []datadogV2.Metric
 	return matrixToSeries(name, metricType, matrix)
 }
 
+// CertExpirySeries reports how long each client cert in expiries has left at now, so a monitor
+// can warn before it lapses.
+func CertExpirySeries(expiries map[string]time.Time, now time.Time) []datadogV2.MetricSeries {
+	series := []datadogV2.MetricSeries{}
+	for file, notAfter := range expiries {
+		tag, timestamp, value := "cert_file", now.Unix(), notAfter.Sub(now).Seconds()
+		series = append(series, datadogV2.MetricSeries{
+			Metric:    CertExpiryName,
+			Type:      datadogV2.METRICINTAKETYPE_GAUGE.Ptr(),
+			Points:    []datadogV2.MetricPoint{{Timestamp: &timestamp, Value: &value}},
+			Resources: []datadogV2.MetricResource{{Type: &tag, Name: &file}},
+		})
+	}
+	return series
+}
+
 func matrixToSeries(name string, metricType datadogV2.MetricIntakeType, matrix model.Matrix) []datadogV2.MetricSeries {
 	series := make([]datadogV2.MetricSeries, len(matrix))
 	for i, stream := range matrix {
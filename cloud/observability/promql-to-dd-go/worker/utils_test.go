@@ -106,3 +106,17 @@ func TestPromHistogramToDatadogGauge(t *testing.T) {
 		})
 	}
 }
+
+func TestCertExpirySeries(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	gotSeries := CertExpirySeries(map[string]time.Time{"/certs/client.crt": now.Add(48 * time.Hour)}, now)
+
+	assert.Equal(t, []datadogV2.MetricSeries{
+		{
+			Metric:    CertExpiryName,
+			Type:      datadogV2.METRICINTAKETYPE_GAUGE.Ptr(),
+			Points:    []datadogV2.MetricPoint{{Timestamp: Ptr(now.Unix()), Value: Ptr(float64(48 * 60 * 60))}},
+			Resources: []datadogV2.MetricResource{{Type: Ptr("cert_file"), Name: Ptr("/certs/client.crt")}},
+		},
+	}, gotSeries)
+}
@@ -25,6 +25,7 @@ type Worker struct {
 const (
 	HistogramPromQL = "histogram_quantile(%.2f, sum(rate(%s[1m])) by (temporal_namespace,operation,le))"
 	RatePromQL      = "rate(%s[1m])"
+	CertExpiryName  = "promqltodd_client_cert_expires_in_seconds"
 	RetryInterval   = 3 * time.Second
 )
 
@@ -95,6 +96,7 @@ func (w *Worker) do(errorChan chan<- error) {
 
 	log.Printf("Submitting to Datadog\n")
 	series := append(histogramSeries, rateSeries...)
+	series = append(series, CertExpirySeries(prometheus.ClientCertExpiries(), time.Now())...)
 	err = w.SubmitMetrics(series)
 	if err != nil {
 		errorChan <- err
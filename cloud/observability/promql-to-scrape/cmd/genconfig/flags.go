@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+)
+
+// clientFlags are the flags needed to connect to the Prometheus API, shared by every subcommand.
+type clientFlags struct {
+	promURL            *string
+	serverRootCACert   *string
+	clientCert         *string
+	clientKey          *string
+	serverName         *string
+	insecureSkipVerify *bool
+
+	bearerTokenFile       *string
+	bearerTokenEnv        *string
+	basicAuthUsername     *string
+	basicAuthPasswordFile *string
+	basicAuthPasswordEnv  *string
+}
+
+func addClientFlags(set *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		promURL:            set.String("prom-endpoint", "", "Prometheus API endpoint for the server eg. https://<account>.tmprl.cloud/prometheus"),
+		serverRootCACert:   set.String("server-root-ca-cert", "", "Optional path to root server CA cert"),
+		clientCert:         set.String("client-cert", "", "Path to client cert for mTLS"),
+		clientKey:          set.String("client-key", "", "Path to client key for mTLS"),
+		serverName:         set.String("server-name", "", "Optional server name to use for verifying the server's certificate"),
+		insecureSkipVerify: set.Bool("insecure-skip-verify", false, "Skip verification of the server's certificate and host name"),
+
+		bearerTokenFile:       set.String("bearer-token-file", "", "Path to a bearer token such as an API key"),
+		bearerTokenEnv:        set.String("bearer-token-env", "", "Environment variable holding a bearer token such as an API key"),
+		basicAuthUsername:     set.String("basic-auth-username", "", "Username for basic auth"),
+		basicAuthPasswordFile: set.String("basic-auth-password-file", "", "Path to the basic auth password"),
+		basicAuthPasswordEnv:  set.String("basic-auth-password-env", "", "Environment variable holding the basic auth password"),
+	}
+}
+
+// querier returns the client for -prom-endpoint, or nil if it is not set.
+func (f *clientFlags) querier() (internal.Querier, error) {
+	if *f.promURL == "" {
+		return nil, nil
+	}
+	return internal.NewAPIClient(internal.APIConfig{
+		TargetHost:         *f.promURL,
+		ServerRootCACert:   *f.serverRootCACert,
+		ClientCert:         *f.clientCert,
+		ClientKey:          *f.clientKey,
+		ServerName:         *f.serverName,
+		InsecureSkipVerify: *f.insecureSkipVerify,
+
+		BearerTokenFile:       *f.bearerTokenFile,
+		BearerTokenEnv:        *f.bearerTokenEnv,
+		BasicAuthUsername:     *f.basicAuthUsername,
+		BasicAuthPasswordFile: *f.basicAuthPasswordFile,
+		BasicAuthPasswordEnv:  *f.basicAuthPasswordEnv,
+	})
+}
@@ -13,72 +13,98 @@ import (
 )
 
 func main() {
-	set := flag.NewFlagSet("app", flag.ExitOnError)
-	promURL := set.String("prom-endpoint", "", "Required Prometheus API endpoint for the server eg. https://<account>.tmprl.cloud/prometheus")
-	serverRootCACert := set.String("server-root-ca-cert", "", "Optional path to root server CA cert")
-	clientCert := set.String("client-cert", "", "Required path to client cert")
-	clientKey := set.String("client-key", "", "Required path to client key")
-	serverName := set.String("server-name", "", "Optional server name to use for verifying the server's certificate")
-	insecureSkipVerify := set.Bool("insecure-skip-verify", false, "Skip verification of the server's certificate and host name")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+		return
+	}
+
+	set := flag.NewFlagSet("genconfig", flag.ExitOnError)
+	client := addClientFlags(set)
+	rulesFile := set.String("rules", "", "Optional rule file describing the queries to generate per metric, see cmd/genconfig/rules.yaml for the defaults")
+	prefix := set.String("prefix", "temporal_cloud_v0", "Only metrics whose name starts with this prefix are discovered")
+	out := set.String("out", "config.yaml", "File to write the generated config to, or - for stdout")
+	merge := set.String("merge", "", "Optional existing config to add newly discovered metrics to, keeping its entries as they are")
+	check := set.Bool("check", false, "With -merge, only print the differences and exit 1 if metrics were added or vanished upstream")
 
 	if err := set.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("failed parsing args: %s", err)
-	} else if *clientCert == "" || *clientKey == "" {
-		log.Fatalf("-client-cert and -client-key are required")
+	} else if *check && *merge == "" {
+		log.Fatalf("-check needs -merge")
 	}
 
-	client, err := internal.NewAPIClient(
-		internal.APIConfig{
-			TargetHost:         *promURL,
-			ServerRootCACert:   *serverRootCACert,
-			ClientCert:         *clientCert,
-			ClientKey:          *clientKey,
-			ServerName:         *serverName,
-			InsecureSkipVerify: *insecureSkipVerify,
-		},
-	)
+	rules, err := loadRules(*rulesFile)
 	if err != nil {
-		log.Fatalf("Failed to create Prometheus client: %s", err)
+		log.Fatalf("Failed to load rules: %s", err)
 	}
 
-	counters, gauges, histograms, err := client.ListMetrics("temporal_cloud_v0")
+	apiClient, err := client.querier()
 	if err != nil {
-		log.Fatalf("Failed to pull metric names: %s", err)
+		log.Fatalf("Failed to create Prometheus client: %s", err)
+	} else if apiClient == nil {
+		log.Fatalf("-prom-endpoint is required")
 	}
-	fmt.Println(counters)
-	fmt.Println(gauges)
-	fmt.Println(histograms)
 
-	conf := internal.Config{}
+	conf, discovered, err := generateConfig(apiClient, rules, *prefix)
+	if err != nil {
+		log.Fatalf("Failed to generate config: %s", err)
+	}
 
-	for _, counter := range counters {
-		conf.Metrics = append(conf.Metrics, internal.Metric{
-			MetricName: fmt.Sprintf("%s:rate1m", counter),
-			Query:      fmt.Sprintf("rate(%s[1m])", counter),
-		})
+	yamlData, err := yaml.Marshal(conf)
+	if err != nil {
+		log.Fatalf("error marshalling yaml: %v", err)
 	}
-	for _, gauge := range gauges {
-		conf.Metrics = append(conf.Metrics, internal.Metric{
-			MetricName: gauge,
-			Query:      gauge,
-		})
+	if *merge != "" {
+		existing, err := os.ReadFile(*merge)
+		if err != nil {
+			log.Fatalf("Failed to read config to merge: %s", err)
+		}
+		var result mergeResult
+		yamlData, result, err = mergeConfig(existing, conf.Metrics, discovered, *prefix)
+		if err != nil {
+			log.Fatalf("Failed to merge config: %s", err)
+		}
+		result.print(os.Stderr, *merge)
+		if *check {
+			if result.changed() {
+				os.Exit(1)
+			}
+			return
+		}
 	}
-	for _, histogram := range histograms {
-		conf.Metrics = append(conf.Metrics, internal.Metric{
-			MetricName: fmt.Sprintf("%s:histogram_quantile_p99_1m", histogram),
-			Query:      fmt.Sprintf("histogram_quantile(0.99, sum(rate(%s[1m])) by (le, operation, temporal_namespace))", histogram),
-		})
+	// the rules are free-form, so make sure they produced a config promql-to-scrape accepts
+	if _, err := internal.ParseConfig(yamlData); err != nil {
+		log.Fatalf("generated config is invalid: %v", err)
 	}
 
-	sort.Sort(internal.ByMetricName(conf.Metrics))
+	if *out == "-" {
+		_, err = os.Stdout.Write(yamlData)
+	} else {
+		err = os.WriteFile(*out, yamlData, 0644)
+	}
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+}
 
-	yamlData, err := yaml.Marshal(&conf)
+// generateConfig discovers the metrics starting with prefix and generates their queries. The
+// discovered metric names are returned too.
+func generateConfig(client internal.Querier, rules *ruleFile, prefix string) (*internal.Config, []string, error) {
+	counters, gauges, histograms, err := client.ListMetrics(prefix)
 	if err != nil {
-		log.Fatalf("error marshalling yaml: %v", err)
+		return nil, nil, fmt.Errorf("failed to pull metric names: %w", err)
 	}
+	log.Printf("found %d counters: %v", len(counters), counters)
+	log.Printf("found %d gauges: %v", len(gauges), gauges)
+	log.Printf("found %d histograms: %v", len(histograms), histograms)
 
-	err = os.WriteFile("config.yaml", yamlData, 0644)
+	names := append(append(append([]string{}, counters...), gauges...), histograms...)
+	sort.Strings(names)
+	metrics, err := rules.generate(names)
 	if err != nil {
-		log.Fatalf("error: %v", err)
+		return nil, nil, err
 	}
+
+	conf := &internal.Config{Metrics: metrics}
+	sort.Sort(internal.ByMetricName(conf.Metrics))
+	return conf, names, nil
 }
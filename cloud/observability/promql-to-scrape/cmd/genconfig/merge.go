@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"gopkg.in/yaml.v3"
+)
+
+// vanishedComment flags, as a head comment, metrics whose query uses a metric no longer
+// found upstream.
+const vanishedComment = "genconfig: no longer found upstream:"
+
+// mergeResult is how merging changed an existing config.
+type mergeResult struct {
+	// added are the generated metrics the config did not have.
+	added []internal.Metric
+	// vanished are the metrics of the config whose query uses a discovered-prefix metric that
+	// is no longer found upstream, and those metrics.
+	vanished []vanishedMetric
+	// edited are the metrics of the config whose query differs from the generated one. They
+	// are kept as they are.
+	edited []editedMetric
+}
+
+type vanishedMetric struct {
+	name    string
+	missing []string
+}
+
+type editedMetric struct {
+	name, query, generated string
+}
+
+// changed reports whether upstream has metrics the config is missing, or the config uses
+// metrics upstream no longer has.
+func (r mergeResult) changed() bool {
+	return len(r.added) > 0 || len(r.vanished) > 0
+}
+
+// print writes r as a human readable diff: + for added metrics, - for vanished ones and ~
+// for kept edits.
+func (r mergeResult) print(w io.Writer, file string) {
+	fmt.Fprintf(w, "%s: %d new, %d vanished, %d edited metrics\n", file, len(r.added), len(r.vanished), len(r.edited))
+	for _, m := range r.added {
+		fmt.Fprintf(w, "+ %s: %s\n", m.MetricName, m.Query)
+	}
+	for _, m := range r.vanished {
+		fmt.Fprintf(w, "- %s: %s no longer found upstream\n", m.name, strings.Join(m.missing, ", "))
+	}
+	for _, m := range r.edited {
+		fmt.Fprintf(w, "~ %s: kept %s, generated %s\n", m.name, m.query, m.generated)
+	}
+}
+
+// mergeConfig adds the generated metrics missing from the top-level metrics of the existing
+// config, leaving every other entry and setting as it is, comments included. discovered are
+// the metric names found upstream with prefix. Existing metrics using a metric with prefix
+// that was not discovered are flagged with a comment.
+func mergeConfig(existing []byte, generated []internal.Metric, discovered []string, prefix string) ([]byte, mergeResult, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(existing, &doc); err != nil {
+		return nil, mergeResult{}, fmt.Errorf("failed to parse existing config: %w", err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, mergeResult{}, errors.New("existing config is not a mapping")
+	}
+	metrics := mappingValue(root, "metrics")
+	if metrics == nil {
+		metrics = &yaml.Node{Kind: yaml.SequenceNode}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "metrics"}, metrics)
+	}
+
+	found := make(map[string]bool, len(discovered))
+	for _, name := range discovered {
+		found[name] = true
+	}
+	byName := make(map[string]internal.Metric, len(generated))
+	for _, m := range generated {
+		byName[m.MetricName] = m
+	}
+
+	var result mergeResult
+	have := map[string]bool{}
+	for _, item := range metrics.Content {
+		var m internal.Metric
+		if err := item.Decode(&m); err != nil {
+			return nil, mergeResult{}, fmt.Errorf("failed to parse existing metric at line %d: %w", item.Line, err)
+		}
+		have[m.MetricName] = true
+
+		if g, ok := byName[m.MetricName]; ok && g.Query != m.Query {
+			result.edited = append(result.edited, editedMetric{name: m.MetricName, query: m.Query, generated: g.Query})
+		}
+
+		used, err := selectedMetrics(m.Query)
+		if err != nil {
+			return nil, mergeResult{}, fmt.Errorf("failed to parse query of %s: %w", m.MetricName, err)
+		}
+		var missing []string
+		for _, name := range used {
+			if strings.HasPrefix(name, prefix) && !found[name] {
+				missing = append(missing, name)
+			}
+		}
+		item.HeadComment = flagVanished(item.HeadComment, missing)
+		if len(missing) > 0 {
+			result.vanished = append(result.vanished, vanishedMetric{name: m.MetricName, missing: missing})
+		}
+	}
+
+	for _, m := range generated {
+		if have[m.MetricName] {
+			continue
+		}
+		var item yaml.Node
+		if err := item.Encode(m); err != nil {
+			return nil, mergeResult{}, err
+		}
+		metrics.Content = append(metrics.Content, &item)
+		result.added = append(result.added, m)
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return nil, mergeResult{}, err
+	}
+	return out, result, nil
+}
+
+// mappingValue returns the value of key in the mapping node m, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// selectedMetrics returns the sorted metric names selected by query.
+func selectedMetrics(query string) ([]string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]struct{}{}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && vs.Name != "" {
+			names[vs.Name] = struct{}{}
+		}
+		return nil
+	})
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// flagVanished replaces the vanished flag in comment by one listing missing, if any.
+func flagVanished(comment string, missing []string) string {
+	var lines []string
+	for _, line := range strings.Split(comment, "\n") {
+		if line != "" && !strings.Contains(line, vanishedComment) {
+			lines = append(lines, line)
+		}
+	}
+	if len(missing) > 0 {
+		lines = append(lines, "# "+vanishedComment+" "+strings.Join(missing, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+)
+
+func TestMergeConfig(t *testing.T) {
+	existing := `interval: 2m
+metrics:
+    # tuned by hand
+    - metric_name: temporal_cloud_v0_poll_success_count:rate1m
+      query: sum(rate(temporal_cloud_v0_poll_success_count[5m])) by (temporal_namespace)
+    - metric_name: temporal_cloud_v0_old_count:rate1m
+      query: rate(temporal_cloud_v0_old_count[1m])
+    - metric_name: global_latency
+      query: histogram_quantile(0.99, sum(rate(temporal_cloud_v0_service_latency_bucket[1m])) by (le))
+`
+	generated := []internal.Metric{
+		{MetricName: "temporal_cloud_v0_new_count:rate1m", Query: "rate(temporal_cloud_v0_new_count[1m])"},
+		{MetricName: "temporal_cloud_v0_poll_success_count:rate1m", Query: "rate(temporal_cloud_v0_poll_success_count[1m])"},
+	}
+	discovered := []string{"temporal_cloud_v0_new_count", "temporal_cloud_v0_poll_success_count", "temporal_cloud_v0_service_latency_bucket"}
+
+	out, result, err := mergeConfig([]byte(existing), generated, discovered, "temporal_cloud_v0")
+	if err != nil {
+		t.Fatalf("mergeConfig() = %v", err)
+	}
+	if !result.changed() {
+		t.Error("merge reported no change")
+	}
+
+	conf, err := internal.ParseConfig(out)
+	if err != nil {
+		t.Fatalf("merged config is invalid: %v\n%s", err, out)
+	}
+	queries := map[string]string{}
+	for _, m := range conf.Metrics {
+		queries[m.MetricName] = m.Query
+	}
+	if got := queries["temporal_cloud_v0_poll_success_count:rate1m"]; !strings.HasPrefix(got, "sum(") {
+		t.Errorf("edited query was replaced by %q", got)
+	}
+	if _, ok := queries["temporal_cloud_v0_new_count:rate1m"]; !ok {
+		t.Error("newly discovered metric was not added")
+	}
+	if _, ok := queries["temporal_cloud_v0_old_count:rate1m"]; !ok {
+		t.Error("vanished metric was removed")
+	}
+	for _, want := range []string{"interval: 2m", "# tuned by hand", "# " + vanishedComment + " temporal_cloud_v0_old_count"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("merged config lost %q:\n%s", want, out)
+		}
+	}
+
+	var diff bytes.Buffer
+	result.print(&diff, "config.yaml")
+	want := `config.yaml: 1 new, 1 vanished, 1 edited metrics
++ temporal_cloud_v0_new_count:rate1m: rate(temporal_cloud_v0_new_count[1m])
+- temporal_cloud_v0_old_count:rate1m: temporal_cloud_v0_old_count no longer found upstream
+~ temporal_cloud_v0_poll_success_count:rate1m: kept sum(rate(temporal_cloud_v0_poll_success_count[5m])) by (temporal_namespace), generated rate(temporal_cloud_v0_poll_success_count[1m])
+`
+	if diff.String() != want {
+		t.Errorf("got diff\n%s\nwant\n%s", diff.String(), want)
+	}
+
+	// merging again once the metric is back upstream is a no-op apart from the flag
+	again, result, err := mergeConfig(out, generated, append(discovered, "temporal_cloud_v0_old_count"), "temporal_cloud_v0")
+	if err != nil {
+		t.Fatalf("second mergeConfig() = %v", err)
+	}
+	if result.changed() {
+		t.Errorf("second merge reported changes: %+v", result)
+	}
+	if bytes.Contains(again, []byte(vanishedComment)) {
+		t.Errorf("vanished flag was kept after the metric came back:\n%s", again)
+	}
+}
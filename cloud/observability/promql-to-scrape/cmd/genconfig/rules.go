@@ -0,0 +1,185 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRules reproduce the queries genconfig always generated: a p99 per histogram, a 1m
+// rate per counter and every gauge as is.
+//
+//go:embed rules.yaml
+var defaultRules []byte
+
+// ruleFile lists the rules used to generate queries for discovered metrics.
+type ruleFile struct {
+	Rules []*rule `yaml:"rules"`
+}
+
+// rule generates metrics for every discovered metric matching Match, one per combination of
+// Quantiles and Windows. MetricName and Query are text/template templates executed with
+// ruleData.
+type rule struct {
+	// Match is a regexp matched against discovered metric names. A capture group named base
+	// sets .Base, eg. ^(?P<base>.+)_bucket$.
+	Match     string    `yaml:"match"`
+	Quantiles []float64 `yaml:"quantiles,omitempty"`
+	Windows   []string  `yaml:"windows,omitempty"`
+	// By are the labels to aggregate by, joined with ", " into .By.
+	By         []string `yaml:"by,omitempty"`
+	MetricName string   `yaml:"metric_name"`
+	Query      string   `yaml:"query"`
+	// Type and Unit are copied to every generated metric.
+	Type string `yaml:"type,omitempty"`
+	Unit string `yaml:"unit,omitempty"`
+
+	match      *regexp.Regexp
+	metricName *template.Template
+	query      *template.Template
+}
+
+// ruleData is what the templates of a rule are executed with.
+type ruleData struct {
+	Metric   string
+	Base     string
+	Quantile float64
+	Window   string
+	By       string
+}
+
+var ruleFuncs = template.FuncMap{
+	// percent formats a quantile for a metric name, eg. 0.99 as 99 and 0.995 as 99_5. It is
+	// rounded to 4 decimals first, as q*100 can be off, eg. 56.99999999999999 for 0.57.
+	"percent": func(q float64) string {
+		return strings.ReplaceAll(strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64), ".", "_")
+	},
+}
+
+// loadRules reads the rule file at path, or the default rules if path is empty.
+func loadRules(path string) (*ruleFile, error) {
+	b := defaultRules
+	if path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read rules: %w", err)
+		}
+	}
+	return parseRules(b)
+}
+
+// parseRules parses and compiles a rule file.
+func parseRules(b []byte) (*ruleFile, error) {
+	var rf ruleFile
+	if err := yaml.Unmarshal(b, &rf); err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+	if len(rf.Rules) == 0 {
+		return nil, errors.New("no rules configured")
+	}
+	for i, r := range rf.Rules {
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %d (%q): %w", i, r.Match, err)
+		}
+	}
+	return &rf, nil
+}
+
+func (r *rule) compile() error {
+	var err error
+	if r.match, err = regexp.Compile(r.Match); err != nil {
+		return fmt.Errorf("invalid match: %w", err)
+	}
+	if r.MetricName == "" || r.Query == "" {
+		return errors.New("metric_name and query are required")
+	}
+	if r.metricName, err = template.New("metric_name").Funcs(ruleFuncs).Option("missingkey=error").Parse(r.MetricName); err != nil {
+		return fmt.Errorf("invalid metric_name: %w", err)
+	}
+	if r.query, err = template.New("query").Funcs(ruleFuncs).Option("missingkey=error").Parse(r.Query); err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+	return nil
+}
+
+// generate returns the metrics generated for names by the first rule each one matches.
+// Names matching no rule are skipped.
+func (rf *ruleFile) generate(names []string) ([]internal.Metric, error) {
+	var metrics []internal.Metric
+	seen := map[string]string{}
+	for _, name := range names {
+		r := rf.find(name)
+		if r == nil {
+			continue
+		}
+		generated, err := r.generate(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate queries for %s: %w", name, err)
+		}
+		for _, metric := range generated {
+			if from, ok := seen[metric.MetricName]; ok {
+				return nil, fmt.Errorf("%s and %s both generate %s, every metric_name must be unique", from, name, metric.MetricName)
+			}
+			seen[metric.MetricName] = name
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics, nil
+}
+
+func (rf *ruleFile) find(name string) *rule {
+	for _, r := range rf.Rules {
+		if r.match.MatchString(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *rule) generate(name string) ([]internal.Metric, error) {
+	data := ruleData{Metric: name, Base: name, By: strings.Join(r.By, ", ")}
+	if i := r.match.SubexpIndex("base"); i >= 0 {
+		if m := r.match.FindStringSubmatch(name); m[i] != "" {
+			data.Base = m[i]
+		}
+	}
+
+	quantiles, windows := r.Quantiles, r.Windows
+	if len(quantiles) == 0 {
+		quantiles = []float64{0}
+	}
+	if len(windows) == 0 {
+		windows = []string{""}
+	}
+
+	var metrics []internal.Metric
+	for _, quantile := range quantiles {
+		for _, window := range windows {
+			data.Quantile, data.Window = quantile, window
+			var metricName, query strings.Builder
+			if err := r.metricName.Execute(&metricName, data); err != nil {
+				return nil, err
+			}
+			if err := r.query.Execute(&query, data); err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, internal.Metric{
+				MetricName: metricName.String(),
+				Query:      query.String(),
+				Type:       r.Type,
+				Unit:       r.Unit,
+			})
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+)
+
+// fakeQuerier discovers a fixed set of metrics.
+type fakeQuerier struct {
+	internal.Querier
+	counters, gauges, histograms []string
+}
+
+func (q fakeQuerier) ListMetrics(string) ([]string, []string, []string, error) {
+	return q.counters, q.gauges, q.histograms, nil
+}
+
+func TestGenerateConfig(t *testing.T) {
+	client := fakeQuerier{
+		counters:   []string{"temporal_cloud_v0_poll_success_count"},
+		gauges:     []string{"temporal_cloud_v0_state_transitions"},
+		histograms: []string{"temporal_cloud_v0_service_latency_bucket"},
+	}
+
+	testCases := []struct {
+		name    string
+		rules   string
+		want    []internal.Metric
+		wantErr bool
+	}{
+		{
+			name: "default rules",
+			want: []internal.Metric{
+				{MetricName: "temporal_cloud_v0_poll_success_count:rate1m", Query: "rate(temporal_cloud_v0_poll_success_count[1m])"},
+				{MetricName: "temporal_cloud_v0_service_latency_bucket:histogram_quantile_p99_1m", Query: "histogram_quantile(0.99, sum(rate(temporal_cloud_v0_service_latency_bucket[1m])) by (le, operation, temporal_namespace))"},
+				{MetricName: "temporal_cloud_v0_state_transitions", Query: "temporal_cloud_v0_state_transitions"},
+			},
+		},
+		{
+			name: "quantiles and windows",
+			rules: `
+rules:
+  - match: ^(?P<base>.+)_bucket$
+    quantiles: [0.5, 0.57, 0.995]
+    windows: [5m]
+    by: [temporal_namespace]
+    metric_name: "{{.Base}}_p{{percent .Quantile}}_{{.Window}}"
+    query: "histogram_quantile({{.Quantile}}, sum(rate({{.Metric}}[{{.Window}}])) by (le, {{.By}}))"
+    unit: seconds
+`,
+			want: []internal.Metric{
+				{MetricName: "temporal_cloud_v0_service_latency_p50_5m", Query: "histogram_quantile(0.5, sum(rate(temporal_cloud_v0_service_latency_bucket[5m])) by (le, temporal_namespace))", Unit: "seconds"},
+				{MetricName: "temporal_cloud_v0_service_latency_p57_5m", Query: "histogram_quantile(0.57, sum(rate(temporal_cloud_v0_service_latency_bucket[5m])) by (le, temporal_namespace))", Unit: "seconds"},
+				{MetricName: "temporal_cloud_v0_service_latency_p99_5_5m", Query: "histogram_quantile(0.995, sum(rate(temporal_cloud_v0_service_latency_bucket[5m])) by (le, temporal_namespace))", Unit: "seconds"},
+			},
+		},
+		{
+			name: "duplicate metric names",
+			rules: `
+rules:
+  - match: _count$
+    windows: [1m, 5m]
+    metric_name: "{{.Metric}}:rate"
+    query: "rate({{.Metric}}[{{.Window}}])"
+`,
+			wantErr: true,
+		},
+		{
+			name: "unknown template field",
+			rules: `
+rules:
+  - match: ""
+    metric_name: "{{.Name}}"
+    query: "{{.Metric}}"
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := loadRules("")
+			if tc.rules != "" {
+				rules, err = parseRules([]byte(tc.rules))
+			}
+			if err != nil {
+				t.Fatalf("failed to load rules: %v", err)
+			}
+
+			conf, _, err := generateConfig(client, rules, "temporal_cloud_v0")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("generateConfig() = %v, want error %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(conf.Metrics, tc.want) {
+				t.Errorf("got metrics %+v, want %+v", conf.Metrics, tc.want)
+			}
+		})
+	}
+}
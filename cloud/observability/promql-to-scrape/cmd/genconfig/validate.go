@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+)
+
+// validate checks the queries of a config: that they are valid PromQL and, with -execute, that
+// they run and return data. It exits 1 if any query failed.
+func validate(args []string) {
+	set := flag.NewFlagSet("genconfig validate", flag.ExitOnError)
+	client := addClientFlags(set)
+	configFile := set.String("config-file", "config.yaml", "Config file to validate")
+	execute := set.Bool("execute", false, "Run every query once against its endpoint and report series counts and latency")
+	failOnEmpty := set.Bool("fail-on-empty", false, "With -execute, also exit 1 if a query returns no series")
+
+	if err := set.Parse(args); err != nil {
+		log.Fatalf("failed parsing args: %s", err)
+	}
+
+	conf, err := internal.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+
+	var apiClient internal.Querier
+	if *execute {
+		if apiClient, err = client.querier(); err != nil {
+			log.Fatalf("Failed to create Prometheus client: %s", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	checks := internal.CheckQueries(ctx, conf, internal.NewClients(apiClient), *execute)
+	if failed := printChecks(os.Stdout, checks, *failOnEmpty); failed > 0 {
+		log.Printf("%d of %d queries failed", failed, len(checks))
+		os.Exit(1)
+	}
+}
+
+// printChecks writes a table of checks and returns how many failed. Empty results count as
+// failures if failOnEmpty is set.
+func printChecks(w io.Writer, checks []internal.QueryCheck, failOnEmpty bool) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	failed := 0
+	fmt.Fprintln(tw, "METRIC\tACCOUNT\tSTATUS\tSERIES\tLATENCY")
+	for _, check := range checks {
+		status, series, latency := "ok", "-", "-"
+		switch {
+		case check.Err != nil:
+			status = "error: " + check.Err.Error()
+			failed++
+		case check.Executed && check.Series == 0:
+			status = "empty"
+			if failOnEmpty {
+				failed++
+			}
+		}
+		if check.Executed {
+			series = fmt.Sprint(check.Series)
+		}
+		if check.Duration > 0 {
+			latency = check.Duration.Round(time.Millisecond).String()
+		}
+		account := check.Metric.Account
+		if account == "" {
+			account = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", check.Metric.MetricName, account, status, series, latency)
+	}
+	return failed
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
+)
+
+// backfill writes the configured metrics over a past window as an OpenMetrics file, to be
+// imported with `promtool tsdb create-blocks-from openmetrics`.
+func backfill(args []string) {
+	set := flag.NewFlagSet("promql-to-scrape backfill", flag.ExitOnError)
+	client := addClientFlags(set)
+	configFile := set.String("config-file", "", "Config file for promql-to-scrape")
+	start := set.String("start", "", "Required start of the window to backfill, RFC 3339 eg. 2024-01-02T15:04:05Z")
+	end := set.String("end", "", "End of the window to backfill, RFC 3339. Defaults to now minus the configured offset")
+	out := set.String("out", "", "File to write OpenMetrics to. Defaults to stdout")
+	queryTimeout := set.Duration("query-timeout", 2*time.Minute, "Timeout of each range query. Windows over 11,000 points per series are split into several queries")
+	debugLogging := set.Bool("debug", false, "Toggle debug logging")
+
+	if err := set.Parse(args); err != nil {
+		log.Fatalf("failed parsing args: %v", err)
+	} else if *configFile == "" || *start == "" {
+		log.Fatalf("-config-file and -start are required")
+	} else if *queryTimeout <= 0 {
+		log.Fatalf("-query-timeout must be positive")
+	}
+
+	setupLogging(*debugLogging)
+
+	conf, err := internal.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("failed to load config file: %v", err)
+	}
+
+	startTime, err := time.Parse(time.RFC3339, *start)
+	if err != nil {
+		log.Fatalf("invalid -start: %v", err)
+	}
+	endTime := time.Now().Add(-*conf.Offset)
+	if *end != "" {
+		if endTime, err = time.Parse(time.RFC3339, *end); err != nil {
+			log.Fatalf("invalid -end: %v", err)
+		}
+	}
+	if !startTime.Before(endTime) {
+		log.Fatalf("-start must be before -end")
+	}
+
+	apiClient, err := client.querier()
+	if err != nil {
+		log.Fatalf("failed to create Prometheus client: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("failed to create output file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := internal.WriteBackfill(ctx, w, conf, internal.NewClients(apiClient), startTime, endTime, *queryTimeout); err != nil {
+		log.Fatalf("failed to backfill: %v", err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/temporalio/samples-server/cloud/observability/promql-to-scrape/internal"
 
@@ -11,49 +14,113 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		backfill(os.Args[2:])
+		return
+	}
+
 	set := flag.NewFlagSet("promql-to-scrape", flag.ExitOnError)
-	promURL := set.String("prom-endpoint", "", "Required Prometheus API endpoint for the server eg. https://<account>.tmprl.cloud/prometheus")
+	client := addClientFlags(set)
 	configFile := set.String("config-file", "", "Config file for promql-to-scrape")
-	serverRootCACert := set.String("server-root-ca-cert", "", "Optional path to root server CA cert")
-	clientCert := set.String("client-cert", "", "Required path to client cert")
-	clientKey := set.String("client-key", "", "Required path to client key")
-	serverName := set.String("server-name", "", "Optional server name to use for verifying the server's certificate")
-	insecureSkipVerify := set.Bool("insecure-skip-verify", false, "Skip verification of the server's certificate and host name")
 	serverAddr := set.String("bind", "0.0.0.0:9001", "address:port to expose the metrics server on")
 	debugLogging := set.Bool("debug", false, "Toggle debug logging")
 
 	if err := set.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("failed parsing args: %v", err)
-	} else if *clientCert == "" || *clientKey == "" || *configFile == "" || *promURL == "" {
-		log.Fatalf("-client-cert, -client-key, -config-file, -prom-endpoint are required")
+	} else if *configFile == "" {
+		log.Fatalf("-config-file is required")
 	}
 
-	logLevel := slog.LevelInfo
-	if *debugLogging {
-		logLevel = slog.LevelDebug
-	}
-	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
-	slog.SetDefault(slog.New(h))
+	setupLogging(*debugLogging)
 
-	client, err := internal.NewAPIClient(
-		internal.APIConfig{
-			TargetHost:         *promURL,
-			ServerRootCACert:   *serverRootCACert,
-			ClientCert:         *clientCert,
-			ClientKey:          *clientKey,
-			ServerName:         *serverName,
-			InsecureSkipVerify: *insecureSkipVerify,
-		},
-	)
+	apiClient, err := client.querier()
 	if err != nil {
 		log.Fatalf("failed to create Prometheus client: %v", err)
 	}
 
-	conf, err := internal.LoadConfig(*configFile)
+	s, err := internal.NewPromToScrapeServer(apiClient, *configFile, *serverAddr)
 	if err != nil {
-		log.Fatalf("failed to load config file: %v", err)
+		log.Fatalf("failed to start server: %v", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.ReloadConfig() //nolint:errcheck // logged by ReloadConfig
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := s.Run(ctx); err != nil {
+		log.Fatalf("server failed: %v", err)
+	}
+	slog.Info("stopped")
+}
+
+// clientFlags are the flags needed to connect to the Prometheus API, shared by every subcommand.
+// They can be left out when every metric belongs to an account of the config file.
+type clientFlags struct {
+	promURL            *string
+	serverRootCACert   *string
+	clientCert         *string
+	clientKey          *string
+	serverName         *string
+	insecureSkipVerify *bool
+
+	bearerTokenFile       *string
+	bearerTokenEnv        *string
+	basicAuthUsername     *string
+	basicAuthPasswordFile *string
+	basicAuthPasswordEnv  *string
+}
+
+func addClientFlags(set *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		promURL:            set.String("prom-endpoint", "", "Prometheus API endpoint for the top-level metrics eg. https://<account>.tmprl.cloud/prometheus"),
+		serverRootCACert:   set.String("server-root-ca-cert", "", "Optional path to root server CA cert"),
+		clientCert:         set.String("client-cert", "", "Path to client cert for mTLS"),
+		clientKey:          set.String("client-key", "", "Path to client key for mTLS"),
+		serverName:         set.String("server-name", "", "Optional server name to use for verifying the server's certificate"),
+		insecureSkipVerify: set.Bool("insecure-skip-verify", false, "Skip verification of the server's certificate and host name"),
+
+		bearerTokenFile:       set.String("bearer-token-file", "", "Path to a bearer token such as an API key, re-read on every request"),
+		bearerTokenEnv:        set.String("bearer-token-env", "", "Environment variable holding a bearer token such as an API key"),
+		basicAuthUsername:     set.String("basic-auth-username", "", "Username for basic auth"),
+		basicAuthPasswordFile: set.String("basic-auth-password-file", "", "Path to the basic auth password, re-read on every request"),
+		basicAuthPasswordEnv:  set.String("basic-auth-password-env", "", "Environment variable holding the basic auth password"),
+	}
+}
+
+// querier returns the client for the top-level metrics, or nil if -prom-endpoint is not set.
+// At least one of mTLS, a bearer token or basic auth is required with -prom-endpoint.
+func (f *clientFlags) querier() (internal.Querier, error) {
+	if *f.promURL == "" {
+		return nil, nil
 	}
+	return internal.NewAPIClient(internal.APIConfig{
+		TargetHost:         *f.promURL,
+		ServerRootCACert:   *f.serverRootCACert,
+		ClientCert:         *f.clientCert,
+		ClientKey:          *f.clientKey,
+		ServerName:         *f.serverName,
+		InsecureSkipVerify: *f.insecureSkipVerify,
 
-	s := internal.NewPromToScrapeServer(client, conf, *serverAddr)
-	s.Start()
+		BearerTokenFile:       *f.bearerTokenFile,
+		BearerTokenEnv:        *f.bearerTokenEnv,
+		BasicAuthUsername:     *f.basicAuthUsername,
+		BasicAuthPasswordFile: *f.basicAuthPasswordFile,
+		BasicAuthPasswordEnv:  *f.basicAuthPasswordEnv,
+	})
+}
+
+func setupLogging(debug bool) {
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
+	}
+	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(h))
 }
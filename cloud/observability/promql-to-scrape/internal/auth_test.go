@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewRoundTripper(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("api-key-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PROM_PASSWORD", "hunter2")
+
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+	defer srv.Close()
+
+	testCases := []struct {
+		name      string
+		cfg       APIConfig
+		rotate    string
+		wantErr   bool
+		checkAuth func(t *testing.T, r *http.Request)
+	}{
+		{
+			name: "bearer token from file",
+			cfg:  APIConfig{BearerTokenFile: tokenFile},
+			checkAuth: func(t *testing.T, r *http.Request) {
+				if auth := r.Header.Get("Authorization"); auth != "Bearer api-key-1" {
+					t.Errorf("got Authorization %q", auth)
+				}
+			},
+		},
+		{
+			name:   "rotated bearer token",
+			cfg:    APIConfig{BearerTokenFile: tokenFile},
+			rotate: "api-key-2",
+			checkAuth: func(t *testing.T, r *http.Request) {
+				if auth := r.Header.Get("Authorization"); auth != "Bearer api-key-2" {
+					t.Errorf("got Authorization %q after rotation", auth)
+				}
+			},
+		},
+		{
+			name: "basic auth from env",
+			cfg:  APIConfig{BasicAuthUsername: "prometheus", BasicAuthPasswordEnv: "TEST_PROM_PASSWORD"},
+			checkAuth: func(t *testing.T, r *http.Request) {
+				if user, pass, ok := r.BasicAuth(); !ok || user != "prometheus" || pass != "hunter2" {
+					t.Errorf("got basic auth %q %q %t", user, pass, ok)
+				}
+			},
+		},
+		{
+			name:    "no authentication",
+			cfg:     APIConfig{},
+			wantErr: true,
+		},
+		{
+			name:    "bearer token and basic auth",
+			cfg:     APIConfig{BearerTokenFile: tokenFile, BasicAuthUsername: "prometheus", BasicAuthPasswordEnv: "TEST_PROM_PASSWORD"},
+			wantErr: true,
+		},
+		{
+			name:    "unset environment variable",
+			cfg:     APIConfig{BearerTokenEnv: "TEST_PROM_MISSING"},
+			wantErr: true,
+		},
+		{
+			name:    "client cert without key",
+			cfg:     APIConfig{ClientCert: "client.crt", BearerTokenFile: tokenFile},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt, err := NewRoundTripper(tc.cfg)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewRoundTripper() = %v, want error %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if tc.rotate != "" {
+				if err := os.WriteFile(tokenFile, []byte(tc.rotate), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			tc.checkAuth(t, got)
+		})
+	}
+}
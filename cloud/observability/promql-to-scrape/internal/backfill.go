@@ -0,0 +1,397 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
+)
+
+// backfillState is the content of BackfillConfig.StateFile.
+type backfillState struct {
+	LastEvaluated map[string]time.Time `json:"last_evaluated"`
+}
+
+func loadBackfillState(path string) (map[string]time.Time, error) {
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]time.Time{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state backfillState
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse backfill state %s: %w", path, err)
+	}
+	if state.LastEvaluated == nil {
+		state.LastEvaluated = map[string]time.Time{}
+	}
+	return state.LastEvaluated, nil
+}
+
+// saveBackfillState writes the state through a temporary file so a crash never leaves it
+// half-written.
+func saveBackfillState(path string, lastEvaluated map[string]time.Time) error {
+	bytes, err := json.Marshal(backfillState{LastEvaluated: lastEvaluated})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// findGap returns the evaluation window missed between a metric's last evaluation and now, if
+// more than one and a half intervals passed. The window never reaches further back than
+// maxWindow and leaves out now itself, which the live sample covers.
+func findGap(metric Metric, last, now time.Time, maxWindow time.Duration) (promapi.Range, bool) {
+	if last.IsZero() || now.Sub(last) <= metric.Interval*3/2 {
+		return promapi.Range{}, false
+	}
+
+	start := last.Add(metric.Interval)
+	if earliest := now.Add(-maxWindow); start.Before(earliest) {
+		start = earliest
+	}
+	end := now.Add(-metric.Interval)
+	if end.Before(start) {
+		return promapi.Range{}, false
+	}
+	return promapi.Range{Start: start, End: end, Step: metric.Interval}, true
+}
+
+// maxRangePoints is how many points per series a single range query may resolve to. The
+// Prometheus API rejects queries over 11,000.
+const maxRangePoints = 11000
+
+// splitRange cuts r into consecutive ranges of at most maxPoints points each.
+func splitRange(r promapi.Range, maxPoints int) []promapi.Range {
+	if r.Step <= 0 {
+		return []promapi.Range{r}
+	}
+	span := r.Step * time.Duration(maxPoints-1)
+	var chunks []promapi.Range
+	for start := r.Start; !start.After(r.End); start = start.Add(span + r.Step) {
+		end := start.Add(span)
+		if end.After(r.End) {
+			end = r.End
+		}
+		chunks = append(chunks, promapi.Range{Start: start, End: end, Step: r.Step})
+	}
+	return chunks
+}
+
+// queryRange runs a range query in chunks small enough for the Prometheus API, each bounded by
+// timeout, and joins the points of each series back together.
+func queryRange(ctx context.Context, client Querier, query string, r promapi.Range, timeout time.Duration) (model.Matrix, error) {
+	var matrix model.Matrix
+	streams := map[model.Fingerprint]*model.SampleStream{}
+	for _, chunk := range splitRange(r, maxRangePoints) {
+		queryCtx, cancel := context.WithTimeout(ctx, timeout)
+		part, err := client.QueryMetricsRange(queryCtx, query, chunk)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, stream := range part {
+			fp := stream.Metric.Fingerprint()
+			if joined, ok := streams[fp]; ok {
+				joined.Values = append(joined.Values, stream.Values...)
+				continue
+			}
+			joined := &model.SampleStream{Metric: stream.Metric, Values: slices.Clone(stream.Values)}
+			streams[fp] = joined
+			matrix = append(matrix, joined)
+		}
+	}
+	return matrix, nil
+}
+
+// queryRanges runs a range query for each metric in ranges, at most conf.Concurrency at a
+// time, and returns the relabeled results of the ones that succeeded. Each query is bounded by
+// timeout, or the metric's own timeout if it is zero.
+func queryRanges(ctx context.Context, conf *Config, client Querier, metrics []Metric, ranges map[string]promapi.Range, timeout time.Duration) (map[string]model.Matrix, QueryErrors) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = map[string]model.Matrix{}
+		errs    = QueryErrors{}
+		sem     = make(chan struct{}, conf.Concurrency)
+	)
+	for _, metric := range metrics {
+		r, ok := ranges[metric.key()]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				mu.Lock()
+				errs[metric.key()] = ctx.Err()
+				mu.Unlock()
+				return
+			}
+
+			queryTimeout := timeout
+			if queryTimeout == 0 {
+				queryTimeout = metric.Timeout
+			}
+			matrix, err := queryRange(ctx, client, metric.Query, r, queryTimeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[metric.key()] = fmt.Errorf("failed to query range for %s: %w", metric.MetricName, err)
+				return
+			}
+			results[metric.key()] = relabelStreams(matrix, slices.Concat(conf.RelabelConfigs, metric.RelabelConfigs))
+		}()
+	}
+	wg.Wait()
+
+	return results, errs
+}
+
+// backfillGaps fills the windows missed by the metrics in data since their last evaluation.
+func (s *PromToScrapeServer) backfillGaps(ctx context.Context, conf, group *Config, client Querier, data Data, evaluated time.Time) map[string]model.Matrix {
+	ranges := map[string]promapi.Range{}
+	s.RLock()
+	for _, metric := range group.Metrics {
+		if _, ok := data[metric.key()]; !ok {
+			continue
+		}
+		if r, ok := findGap(metric, s.lastEvaluated[metric.key()], evaluated.Add(-*metric.Offset), conf.Backfill.MaxWindow); ok {
+			ranges[metric.key()] = r
+		}
+	}
+	s.RUnlock()
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	results, errs := queryRanges(ctx, group, client, group.Metrics, ranges, 0)
+	for name, err := range errs {
+		slog.Warn("failed to backfill metric", "metric", name, "error", err)
+	}
+	for name, r := range ranges {
+		if _, ok := results[name]; ok {
+			slog.Info("backfilled metric", "metric", name, "start", r.Start, "end", r.End)
+		}
+	}
+	return results
+}
+
+// saveLastEvaluated persists the last evaluation time of every metric, if a state file is set.
+func (s *PromToScrapeServer) saveLastEvaluated(conf *Config) {
+	if !conf.Backfill.Enabled || conf.Backfill.StateFile == "" {
+		return
+	}
+
+	s.RLock()
+	lastEvaluated := make(map[string]time.Time, len(s.lastEvaluated))
+	for name, t := range s.lastEvaluated {
+		lastEvaluated[name] = t
+	}
+	s.RUnlock()
+
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if err := saveBackfillState(conf.Backfill.StateFile, lastEvaluated); err != nil {
+		slog.Error("failed to save backfill state", "file", conf.Backfill.StateFile, "error", err)
+	}
+}
+
+// addBackfill puts the backfilled points of fresh metrics ahead of the live sample of their
+// series in mfs, creating families for metrics that have no live samples. The points of each
+// series stay together and in time order, as OpenMetrics requires.
+func addBackfill(mfs []*dto.MetricFamily, states map[string]*metricState, threshold time.Duration, now time.Time) []*dto.MetricFamily {
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+
+	backfilled := map[string][]*dto.Metric{}
+	for key, state := range states {
+		if len(state.backfill) == 0 || now.Sub(state.lastSuccess) >= threshold {
+			continue
+		}
+
+		points, err := streamsToMetrics(state.metric, state.backfill)
+		if err != nil {
+			slog.Error("dropping invalid backfill samples", "metric", key, "error", err)
+		}
+		if len(points) == 0 {
+			continue
+		}
+
+		name := state.metric.MetricName
+		if _, ok := families[name]; !ok {
+			metricName, help := name, state.metric.help()
+			mf := &dto.MetricFamily{
+				Name: &metricName,
+				Help: &help,
+				Type: state.metric.dtoType(),
+			}
+			families[name] = mf
+			mfs = append(mfs, mf)
+		}
+		backfilled[name] = append(backfilled[name], points...)
+	}
+
+	for name, points := range backfilled {
+		mf := families[name]
+		// stable, so the backfilled points of a series keep their order ahead of its live sample
+		mf.Metric = append(points, mf.Metric...)
+		sort.SliceStable(mf.Metric, func(i, j int) bool {
+			return compareLabelPairs(mf.Metric[i].GetLabel(), mf.Metric[j].GetLabel()) < 0
+		})
+	}
+
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs
+}
+
+// compareLabelPairs orders two series by their labels, which are sorted by name.
+func compareLabelPairs(a, b []*dto.LabelPair) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := cmp.Or(strings.Compare(a[i].GetName(), b[i].GetName()), strings.Compare(a[i].GetValue(), b[i].GetValue())); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// streamsToMetrics converts range query results into timestamped points. The points of each
+// series stay together and in time order, as OpenMetrics requires.
+func streamsToMetrics(metric Metric, matrix model.Matrix) ([]*dto.Metric, error) {
+	var errs []error
+	var points []*dto.Metric
+	for _, stream := range matrix {
+		labels := seriesLabels(metric, stream.Metric)
+		for _, v := range stream.Values {
+			m, err := newConstMetric(metric, labels, float64(v.Value))
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			point := &dto.Metric{}
+			if err := prometheus.NewMetricWithTimestamp(v.Timestamp.Time(), m).Write(point); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			points = append(points, point)
+		}
+	}
+
+	return points, errors.Join(errs...)
+}
+
+// WriteBackfill runs a range query between start and end for every configured metric, stepping
+// by its interval, and writes the results to w in the OpenMetrics format with explicit
+// timestamps. Long windows are queried in chunks, each bounded by queryTimeout. The output can
+// be turned into TSDB blocks with `promtool tsdb create-blocks-from openmetrics`.
+func WriteBackfill(ctx context.Context, w io.Writer, conf *Config, clients *Clients, start, end time.Time, queryTimeout time.Duration) error {
+	byAccount := map[string][]Metric{}
+	for _, metric := range conf.Metrics {
+		byAccount[metric.Account] = append(byAccount[metric.Account], metric)
+	}
+
+	results := map[string]model.Matrix{}
+	var errs []error
+	for account, metrics := range byAccount {
+		client, err := clients.get(conf, account)
+		if err != nil {
+			return err
+		}
+		ranges := make(map[string]promapi.Range, len(metrics))
+		for _, metric := range metrics {
+			ranges[metric.key()] = promapi.Range{Start: start, End: end, Step: metric.Interval}
+		}
+		accountResults, accountErrs := queryRanges(ctx, conf, client, metrics, ranges, queryTimeout)
+		for key, matrix := range accountResults {
+			results[key] = matrix
+		}
+		for _, err := range accountErrs {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// the metrics of every account sharing a name go into one family
+	metrics := slices.Clone(conf.Metrics)
+	sort.Stable(ByMetricName(metrics))
+	var families []*dto.MetricFamily
+	for _, metric := range metrics {
+		points, err := streamsToMetrics(metric, results[metric.key()])
+		if err != nil {
+			return fmt.Errorf("invalid samples for %s: %w", metric.key(), err)
+		}
+		if len(points) == 0 {
+			continue
+		}
+
+		if n := len(families); n > 0 && families[n-1].GetName() == metric.MetricName {
+			families[n-1].Metric = append(families[n-1].Metric, points...)
+			continue
+		}
+		help := metric.help()
+		mf := &dto.MetricFamily{
+			Name:   &metric.MetricName,
+			Help:   &help,
+			Type:   metric.dtoType(),
+			Metric: points,
+		}
+		if metric.Unit != "" {
+			mf.Unit = &metric.Unit
+		}
+		families = append(families, mf)
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeOpenMetrics), expfmt.WithUnit())
+	for _, mf := range families {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", mf.GetName(), err)
+		}
+	}
+
+	if closer, ok := enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
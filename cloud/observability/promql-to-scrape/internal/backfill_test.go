@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func TestFindGap(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	metric := Metric{MetricName: "m", Interval: time.Minute}
+
+	testCases := []struct {
+		name   string
+		last   time.Time
+		want   promapi.Range
+		wantOK bool
+	}{
+		{
+			name: "never evaluated",
+		},
+		{
+			name: "on schedule",
+			last: now.Add(-time.Minute),
+		},
+		{
+			name:   "missed refreshes",
+			last:   now.Add(-5 * time.Minute),
+			want:   promapi.Range{Start: now.Add(-4 * time.Minute), End: now.Add(-time.Minute), Step: time.Minute},
+			wantOK: true,
+		},
+		{
+			name:   "capped by max window",
+			last:   now.Add(-24 * time.Hour),
+			want:   promapi.Range{Start: now.Add(-time.Hour), End: now.Add(-time.Minute), Step: time.Minute},
+			wantOK: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := findGap(metric, tc.last, now, time.Hour)
+			if ok != tc.wantOK || got != tc.want {
+				t.Errorf("findGap() = %v, %v, want %v, %v", got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+// rangeQuerier answers range queries with one series holding a point of 1 per step, and
+// "fail" with an error. It records the ranges queried.
+type rangeQuerier struct {
+	Querier
+	mu     sync.Mutex
+	ranges []promapi.Range
+}
+
+func (q *rangeQuerier) QueryMetricsRange(ctx context.Context, promql string, r promapi.Range) (model.Matrix, error) {
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		return nil, errors.New("range query not bounded by the query timeout")
+	}
+	if promql == "fail" {
+		return nil, errors.New("bad_data: exceeded maximum resolution")
+	}
+
+	q.mu.Lock()
+	q.ranges = append(q.ranges, r)
+	q.mu.Unlock()
+
+	stream := &model.SampleStream{Metric: model.Metric{"temporal_namespace": "ns", "temporal_service_type": "frontend"}}
+	for ts := r.Start; !ts.After(r.End); ts = ts.Add(r.Step) {
+		stream.Values = append(stream.Values, model.SamplePair{Timestamp: model.TimeFromUnixNano(ts.UnixNano()), Value: 1})
+	}
+	return model.Matrix{stream}, nil
+}
+
+func TestSplitRange(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name string
+		r    promapi.Range
+		want []promapi.Range
+	}{
+		{
+			name: "under the limit",
+			r:    promapi.Range{Start: start, End: start.Add(2 * time.Minute), Step: time.Minute},
+			want: []promapi.Range{{Start: start, End: start.Add(2 * time.Minute), Step: time.Minute}},
+		},
+		{
+			name: "exactly the limit",
+			r:    promapi.Range{Start: start, End: start.Add(4 * time.Minute), Step: time.Minute},
+			want: []promapi.Range{{Start: start, End: start.Add(4 * time.Minute), Step: time.Minute}},
+		},
+		{
+			name: "over the limit",
+			r:    promapi.Range{Start: start, End: start.Add(11 * time.Minute), Step: time.Minute},
+			want: []promapi.Range{
+				{Start: start, End: start.Add(4 * time.Minute), Step: time.Minute},
+				{Start: start.Add(5 * time.Minute), End: start.Add(9 * time.Minute), Step: time.Minute},
+				{Start: start.Add(10 * time.Minute), End: start.Add(11 * time.Minute), Step: time.Minute},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := splitRange(tc.r, 5); !slices.Equal(got, tc.want) {
+				t.Errorf("splitRange() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQueryRanges(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+metrics:
+  - metric_name: long
+    query: long
+  - metric_name: short
+    query: short
+  - metric_name: failing
+    query: fail
+  - metric_name: skipped
+    query: skipped
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// 3 days every 15s is 17,281 points, more than a single query may return
+	long := promapi.Range{Start: start, End: start.Add(72 * time.Hour), Step: 15 * time.Second}
+	ranges := map[string]promapi.Range{
+		"long":    long,
+		"short":   {Start: start, End: start.Add(time.Hour), Step: time.Minute},
+		"failing": {Start: start, End: start.Add(time.Hour), Step: time.Minute},
+	}
+
+	client := &rangeQuerier{}
+	results, errs := queryRanges(context.Background(), conf, client, conf.Metrics, ranges, 30*time.Second)
+
+	if _, ok := errs["failing"]; !ok || len(errs) != 1 {
+		t.Errorf("got errors %v, want only the failing metric", errs)
+	}
+	if _, ok := results["skipped"]; ok {
+		t.Error("metric without a range was queried")
+	}
+	if got := len(client.ranges); got != 3 {
+		t.Errorf("got %d range queries, want 2 for the long window and 1 for the short one", got)
+	}
+	for _, r := range client.ranges {
+		if points := int(r.End.Sub(r.Start)/r.Step) + 1; points > maxRangePoints {
+			t.Errorf("range %v resolves to %d points", r, points)
+		}
+	}
+
+	for key, want := range map[string]int{"long": 17281, "short": 61} {
+		matrix := results[key]
+		if len(matrix) != 1 {
+			t.Fatalf("got %d series for %s, want the chunks joined into 1", len(matrix), key)
+		}
+		values := matrix[0].Values
+		if len(values) != want {
+			t.Errorf("got %d points for %s, want %d", len(values), key, want)
+		}
+		if !slices.IsSortedFunc(values, func(a, b model.SamplePair) int { return int(a.Timestamp - b.Timestamp) }) {
+			t.Errorf("points of %s are out of order", key)
+		}
+		if _, ok := matrix[0].Metric["temporal_service_type"]; ok {
+			t.Errorf("%s was not relabeled: %v", key, matrix[0].Metric)
+		}
+	}
+}
+
+func TestWriteBackfill(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+metrics:
+  - metric_name: poll_latency_seconds
+    query: poll_latency
+    unit: seconds
+    help: Poll latency.
+    interval: 1m
+  - metric_name: requests_total
+    query: requests
+    type: counter
+    help: Requests.
+    interval: 2m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1704067200, 0)
+	want := `# HELP poll_latency_seconds Poll latency.
+# TYPE poll_latency_seconds gauge
+# UNIT poll_latency_seconds seconds
+poll_latency_seconds{temporal_namespace="ns"} 1.0 1.7040672e+09
+poll_latency_seconds{temporal_namespace="ns"} 1.0 1.70406726e+09
+poll_latency_seconds{temporal_namespace="ns"} 1.0 1.70406732e+09
+# HELP requests Requests.
+# TYPE requests counter
+requests_total{temporal_namespace="ns"} 1.0 1.7040672e+09
+requests_total{temporal_namespace="ns"} 1.0 1.70406732e+09
+# EOF
+`
+
+	var buf bytes.Buffer
+	if err := WriteBackfill(context.Background(), &buf, conf, NewClients(&rangeQuerier{}), start, start.Add(2*time.Minute), 30*time.Second); err != nil {
+		t.Fatalf("WriteBackfill() = %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	conf.Metrics[1].Query = "fail"
+	if err := WriteBackfill(context.Background(), &bytes.Buffer{}, conf, NewClients(&rangeQuerier{}), start, start.Add(2*time.Minute), 30*time.Second); err == nil {
+		t.Error("WriteBackfill() with a failing query succeeded")
+	}
+}
+
+func TestAddBackfillKeepsSeriesTogether(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+backfill:
+  enabled: true
+metrics:
+  - metric_name: a
+    query: a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Minute)
+	live := namespaceSamples("x", "y")
+	for _, sample := range live {
+		sample.Timestamp = model.TimeFromUnixNano(now.UnixNano())
+	}
+	stream := func(ns string) *model.SampleStream {
+		return &model.SampleStream{
+			Metric: model.Metric{"temporal_namespace": model.LabelValue(ns)},
+			Values: []model.SamplePair{
+				{Timestamp: model.TimeFromUnixNano(now.Add(-2 * time.Minute).UnixNano()), Value: 1},
+				{Timestamp: model.TimeFromUnixNano(now.Add(-time.Minute).UnixNano()), Value: 1},
+			},
+		}
+	}
+	s := &PromToScrapeServer{metrics: map[string]*metricState{
+		"a": {metric: conf.Metrics[0], samples: live, backfill: model.Matrix{stream("y"), stream("x")}, lastSuccess: now},
+	}}
+	s.conf.Store(conf)
+	s.registry = prometheus.NewRegistry()
+	s.registry.MustRegister(sampleCollector{s})
+
+	mfs, err := s.gather()
+	if err != nil {
+		t.Fatalf("gather() = %v", err)
+	}
+	if len(mfs) != 1 {
+		t.Fatalf("got %d families, want 1", len(mfs))
+	}
+	var got []string
+	for _, m := range mfs[0].GetMetric() {
+		got = append(got, fmt.Sprintf("%s@%d", m.GetLabel()[0].GetValue(), m.GetTimestampMs()))
+	}
+	var want []string
+	for _, ns := range []string{"x", "y"} {
+		for _, ts := range []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute), now} {
+			want = append(want, fmt.Sprintf("%s@%d", ns, ts.UnixMilli()))
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got points %v, want %v", got, want)
+	}
+}
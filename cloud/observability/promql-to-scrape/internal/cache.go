@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
+)
+
+// Cache holds query results shared between refreshes and, for the file and redis caches,
+// between replicas. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the result stored under key, and false if there is none or it expired.
+	Get(ctx context.Context, key string) (model.Vector, bool, error)
+	// Set stores v under key for ttl.
+	Set(ctx context.Context, key string, v model.Vector, ttl time.Duration) error
+	Close() error
+}
+
+// cacheKey identifies the result of query against the endpoint of account evaluated at ts.
+func cacheKey(account, query string, ts time.Time) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", account, query, ts.UnixMilli())))
+	return hex.EncodeToString(h[:])
+}
+
+// newCache returns the cache described by conf.
+func newCache(conf *CacheConfig) (Cache, error) {
+	switch conf.Type {
+	case CacheTypeFile:
+		if err := os.MkdirAll(conf.Directory, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		return &fileCache{dir: conf.Directory}, nil
+	case CacheTypeRedis:
+		return newRedisCache(conf.Redis)
+	default:
+		return &memoryCache{entries: map[string]memoryEntry{}}, nil
+	}
+}
+
+// caches hands out the cache of the current config, rebuilding it when the cache config
+// changes.
+type caches struct {
+	mu    sync.Mutex
+	conf  CacheConfig
+	cache Cache
+}
+
+// check makes sure the cache of conf can be had, replacing the current one if its config
+// changed.
+func (c *caches) check(conf *Config) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conf.Cache == nil {
+		c.replace(CacheConfig{}, nil)
+		return nil
+	}
+	if c.cache != nil && c.conf == *conf.Cache {
+		return nil
+	}
+	cache, err := newCache(conf.Cache)
+	if err != nil {
+		return err
+	}
+	c.replace(*conf.Cache, cache)
+	return nil
+}
+
+func (c *caches) replace(conf CacheConfig, cache Cache) {
+	if c.cache != nil {
+		if err := c.cache.Close(); err != nil {
+			slog.Warn("failed to close cache", "error", err)
+		}
+	}
+	c.conf, c.cache = conf, cache
+}
+
+// close closes the current cache.
+func (c *caches) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replace(CacheConfig{}, nil)
+}
+
+// get returns the current cache, nil if caching is off.
+func (c *caches) get() Cache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache
+}
+
+// memoryCache is a cache local to the process.
+type memoryCache struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	nextSweep time.Time
+}
+
+type memoryEntry struct {
+	v       model.Vector
+	expires time.Time
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) (model.Vector, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false, nil
+	}
+	return e.v, true, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, v model.Vector, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.After(c.nextSweep) {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(time.Minute)
+	}
+	c.entries[key] = memoryEntry{v: v, expires: now.Add(ttl)}
+	return nil
+}
+
+func (c *memoryCache) Close() error {
+	return nil
+}
+
+// fileCache keeps one JSON file per entry in dir, which replicas may share.
+type fileCache struct {
+	dir string
+
+	mu        sync.Mutex
+	nextSweep time.Time
+}
+
+type fileEntry struct {
+	Expires time.Time    `json:"expires"`
+	Vector  model.Vector `json:"vector"`
+}
+
+func (c *fileCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *fileCache) Get(_ context.Context, key string) (model.Vector, bool, error) {
+	b, err := os.ReadFile(c.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	var e fileEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, false, fmt.Errorf("failed to parse cache entry: %w", err)
+	}
+	if time.Now().After(e.Expires) {
+		return nil, false, nil
+	}
+	return e.Vector, true, nil
+}
+
+// Set writes the entry to a temporary file renamed into place, so readers never see half of it.
+func (c *fileCache) Set(_ context.Context, key string, v model.Vector, ttl time.Duration) error {
+	c.sweep()
+	b, err := json.Marshal(fileEntry{Expires: time.Now().Add(ttl), Vector: v})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(key))
+}
+
+// sweep removes expired entries, at most once a minute.
+func (c *fileCache) sweep() {
+	c.mu.Lock()
+	now := time.Now()
+	if now.Before(c.nextSweep) {
+		c.mu.Unlock()
+		return
+	}
+	c.nextSweep = now.Add(time.Minute)
+	c.mu.Unlock()
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		key := strings.TrimSuffix(file.Name(), ".json")
+		if _, ok, err := c.Get(context.Background(), key); err == nil && !ok {
+			os.Remove(c.path(key))
+		}
+	}
+}
+
+func (c *fileCache) Close() error {
+	return nil
+}
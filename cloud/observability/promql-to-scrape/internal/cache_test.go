@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// fakeRedis is a stand-in Redis server handling the commands of redisCache.
+type fakeRedis struct {
+	password string
+
+	mu      sync.Mutex
+	entries map[string]string
+	expires map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T, password string) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	srv := &fakeRedis{password: password, entries: map[string]string{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func (srv *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := srv.password == ""
+	for {
+		cmd, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range cmd.([]any) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		reply := "+OK\r\n"
+		switch {
+		case args[0] == "AUTH":
+			if args[len(args)-1] != srv.password {
+				reply = "-WRONGPASS invalid password\r\n"
+			} else {
+				authed = true
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT":
+		case args[0] == "GET":
+			srv.mu.Lock()
+			v, ok := srv.entries[args[1]]
+			if ok && time.Now().After(srv.expires[args[1]]) {
+				ok = false
+			}
+			srv.mu.Unlock()
+			reply = "$-1\r\n"
+			if ok {
+				reply = "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+			}
+		case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+			ms, _ := strconv.Atoi(args[4])
+			srv.mu.Lock()
+			srv.entries[args[1]] = args[2]
+			srv.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			srv.mu.Unlock()
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		conf *CacheConfig
+	}{
+		{
+			name: "memory",
+			conf: &CacheConfig{Type: CacheTypeMemory},
+		},
+		{
+			name: "file",
+			conf: &CacheConfig{Type: CacheTypeFile, Directory: filepath.Join(t.TempDir(), "cache")},
+		},
+		{
+			name: "redis",
+			conf: &CacheConfig{Type: CacheTypeRedis, Redis: RedisConfig{
+				Address:      startFakeRedis(t, "hunter2"),
+				PasswordFile: passwordFile,
+				DB:           1,
+				KeyPrefix:    defaultRedisKeyPrefix,
+				Timeout:      time.Second,
+			}},
+		},
+	}
+
+	v := model.Vector{{Metric: model.Metric{"temporal_namespace": "ns"}, Value: 1.5, Timestamp: 60000}}
+	ctx := context.Background()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := newCache(tc.conf)
+			if err != nil {
+				t.Fatalf("newCache() = %v", err)
+			}
+			defer cache.Close()
+
+			if _, ok, err := cache.Get(ctx, "missing"); ok || err != nil {
+				t.Errorf("Get() of a missing key = %t, %v", ok, err)
+			}
+			if err := cache.Set(ctx, "key", v, time.Minute); err != nil {
+				t.Fatalf("Set() = %v", err)
+			}
+			got, ok, err := cache.Get(ctx, "key")
+			if !ok || err != nil {
+				t.Fatalf("Get() = %t, %v", ok, err)
+			}
+			if !got[0].Equal(v[0]) {
+				t.Errorf("got %v, want %v", got, v)
+			}
+
+			if err := cache.Set(ctx, "short", v, time.Millisecond); err != nil {
+				t.Fatalf("Set() = %v", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+			if _, ok, _ := cache.Get(ctx, "short"); ok {
+				t.Error("expired entry was returned")
+			}
+		})
+	}
+}
+
+// countingQuerier counts the instant queries it answers.
+type countingQuerier struct {
+	Querier
+	calls atomic.Int32
+}
+
+func (q *countingQuerier) QueryMetricsInstant(_ context.Context, _ string, ts time.Time) (model.Vector, error) {
+	q.calls.Add(1)
+	return model.Vector{{Metric: model.Metric{"temporal_namespace": "ns"}, Value: 1, Timestamp: model.TimeFromUnixNano(ts.UnixNano())}}, nil
+}
+
+func TestQueryMetricsDedup(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+cache:
+  align: 1h
+metrics:
+  - metric_name: a
+    query: rate(temporal_cloud_v0_poll_success_count[1m])
+  - metric_name: b
+    query: rate(temporal_cloud_v0_poll_success_count[1m])
+    labels:
+      copy: "true"
+  - metric_name: c
+    query: temporal_cloud_v0_state_transitions
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &countingQuerier{}
+	data, errs, _ := QueryMetrics(context.Background(), conf, client, nil)
+	if len(errs) > 0 {
+		t.Fatalf("QueryMetrics() errors: %v", errs)
+	}
+	if got := client.calls.Load(); got != 2 {
+		t.Errorf("got %d upstream queries for two distinct queries, want 2", got)
+	}
+	if len(data["a"]) != 1 || len(data["b"]) != 1 {
+		t.Errorf("metrics sharing a query did not both get its result: %v", data)
+	}
+
+	cache, err := newCache(conf.Cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.calls.Store(0)
+	for i := 0; i < 2; i++ {
+		if _, errs, _ := QueryMetrics(context.Background(), conf, client, cache); len(errs) > 0 {
+			t.Fatalf("QueryMetrics() errors: %v", errs)
+		}
+	}
+	if got := client.calls.Load(); got != 2 {
+		t.Errorf("got %d upstream queries over two cached refreshes, want 2", got)
+	}
+	// evaluated at the aligned time, so replicas share it
+	sample := data["c"][0]
+	if sample.Timestamp.Time().Truncate(time.Hour) != sample.Timestamp.Time() {
+		t.Errorf("evaluation time %s is not aligned", sample.Timestamp.Time())
+	}
+
+	// each metric keeps its own timeout, so a shared query would cut one of them short
+	conf.Metrics[1].Timeout = time.Second
+	client.calls.Store(0)
+	if _, errs, _ := QueryMetrics(context.Background(), conf, client, nil); len(errs) > 0 {
+		t.Fatalf("QueryMetrics() errors: %v", errs)
+	}
+	if got := client.calls.Load(); got != 3 {
+		t.Errorf("got %d upstream queries for a query shared with different timeouts, want 3", got)
+	}
+}
@@ -2,10 +2,12 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	promapi "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -15,14 +17,127 @@ import (
 type (
 	Querier interface {
 		ListMetrics(metricPrefix string) ([]string, []string, []string, error)
-		QueryMetricsInstant(promql string) (model.Matrix, error)
+		QueryMetricsInstant(ctx context.Context, promql string, ts time.Time) (model.Vector, error)
+		QueryMetricsRange(ctx context.Context, promql string, r promapi.Range) (model.Matrix, error)
 	}
 
 	APIClient struct {
 		promapi.API
+		http *HttpClient
 	}
 )
 
+// upstreamConfigurable is a Querier whose requests are paced by an UpstreamConfig.
+type upstreamConfigurable interface {
+	SetUpstreamConfig(conf UpstreamConfig)
+}
+
+// Clients hands out the Querier of each account. Clients of accounts are created on first
+// use and reused while their connection settings stay the same.
+type Clients struct {
+	// fallback queries the top-level metrics, nil when no endpoint was given on the command
+	// line.
+	fallback Querier
+
+	mu       sync.Mutex
+	accounts map[APIConfig]Querier
+}
+
+// NewClients returns Clients querying top-level metrics through fallback, which may be nil if
+// the config only has accounts.
+func NewClients(fallback Querier) *Clients {
+	return &Clients{
+		fallback: fallback,
+		accounts: map[APIConfig]Querier{},
+	}
+}
+
+// get returns the Querier for the metrics of account, as configured in conf.
+func (c *Clients) get(conf *Config, account string) (Querier, error) {
+	if account == "" {
+		if c.fallback == nil {
+			return nil, errors.New("top-level metrics need the Prometheus endpoint and client certs given on the command line, or can be moved into accounts")
+		}
+		return c.fallback, nil
+	}
+
+	a, ok := conf.account(account)
+	if !ok {
+		return nil, fmt.Errorf("unknown account %q", account)
+	}
+	apiConf := a.apiConfig()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok := c.accounts[apiConf]; ok {
+		return client, nil
+	}
+	client, err := NewAPIClient(apiConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for account %q: %w", account, err)
+	}
+	client.SetUpstreamConfig(conf.Upstream)
+	c.accounts[apiConf] = client
+	return client, nil
+}
+
+// check makes sure a Querier can be had for every metric of conf, applies its upstream
+// settings, and forgets the clients of accounts conf no longer has.
+func (c *Clients) check(conf *Config) error {
+	if u, ok := c.fallback.(upstreamConfigurable); ok {
+		u.SetUpstreamConfig(conf.Upstream)
+	}
+	for _, metric := range conf.Metrics {
+		if _, err := c.get(conf, metric.Account); err != nil {
+			return err
+		}
+	}
+
+	used := make(map[APIConfig]struct{}, len(conf.Accounts))
+	for _, account := range conf.Accounts {
+		used[account.apiConfig()] = struct{}{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for apiConf, client := range c.accounts {
+		if _, ok := used[apiConf]; !ok {
+			delete(c.accounts, apiConf)
+		} else if u, ok := client.(upstreamConfigurable); ok {
+			u.SetUpstreamConfig(conf.Upstream)
+		}
+	}
+	return nil
+}
+
+// limitedQuerier is a Querier whose queries each hold one of slots while in flight, waiting
+// for a free one first. Queriers sharing slots share the limit.
+type limitedQuerier struct {
+	Querier
+	slots chan struct{}
+}
+
+func (q limitedQuerier) QueryMetricsInstant(ctx context.Context, promql string, ts time.Time) (model.Vector, error) {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-q.slots }()
+	return q.Querier.QueryMetricsInstant(ctx, promql, ts)
+}
+
+func (q limitedQuerier) QueryMetricsRange(ctx context.Context, promql string, r promapi.Range) (model.Matrix, error) {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-q.slots }()
+	return q.Querier.QueryMetricsRange(ctx, promql, r)
+}
+
+// APIConfig is how to reach and authenticate with a Prometheus API. At least one of mTLS,
+// a bearer token or basic auth must be set.
 type APIConfig struct {
 	TargetHost         string
 	ServerRootCACert   string
@@ -30,22 +145,26 @@ type APIConfig struct {
 	ClientKey          string
 	ServerName         string
 	InsecureSkipVerify bool
+
+	// BearerTokenFile or BearerTokenEnv holds a token sent as Authorization: Bearer, eg. a
+	// Temporal Cloud API key.
+	BearerTokenFile string
+	BearerTokenEnv  string
+	// BasicAuthUsername turns on basic auth, with the password held by BasicAuthPasswordFile
+	// or BasicAuthPasswordEnv.
+	BasicAuthUsername     string
+	BasicAuthPasswordFile string
+	BasicAuthPasswordEnv  string
 }
 
 func NewAPIClient(cfg APIConfig) (*APIClient, error) {
-	tlsCfg, err := BuildTLSConfig(
-		cfg.ClientCert,
-		cfg.ClientKey,
-		cfg.ServerRootCACert,
-		cfg.ServerName,
-		cfg.InsecureSkipVerify,
-	)
+	rt, err := NewRoundTripper(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build tls config %w", err)
+		return nil, err
 	}
 
 	httpClient := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		Transport: rt,
 	}
 
 	client, err := NewHttpClient(cfg.TargetHost, httpClient)
@@ -53,7 +172,12 @@ func NewAPIClient(cfg APIConfig) (*APIClient, error) {
 		return nil, fmt.Errorf("failed to build tls client %w", err)
 	}
 
-	return &APIClient{promapi.NewAPI(client)}, nil
+	return &APIClient{API: promapi.NewAPI(client), http: client}, nil
+}
+
+// SetUpstreamConfig changes the rate limit, retries and circuit breaker of the client.
+func (c *APIClient) SetUpstreamConfig(conf UpstreamConfig) {
+	c.http.SetUpstreamConfig(conf)
 }
 
 func (c *APIClient) ListMetrics(metricPrefix string) ([]string, []string, []string, error) {
@@ -82,10 +206,13 @@ func (c *APIClient) ListMetrics(metricPrefix string) ([]string, []string, []stri
 	return counts, gauges, histograms, nil
 }
 
-func (c *APIClient) QueryMetricsInstant(promql string) (model.Vector, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	result, warnings, err := c.API.Query(ctx, promql, time.Now().Add(-60*time.Second), promapi.WithTimeout(10*time.Second))
+// QueryMetricsInstant evaluates promql at ts.
+func (c *APIClient) QueryMetricsInstant(ctx context.Context, promql string, ts time.Time) (model.Vector, error) {
+	var opts []promapi.Option
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, promapi.WithTimeout(time.Until(deadline)))
+	}
+	result, warnings, err := c.API.Query(ctx, promql, ts, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query Temporal Cloud: %w", err)
 	}
@@ -98,3 +225,23 @@ func (c *APIClient) QueryMetricsInstant(promql string) (model.Vector, error) {
 	}
 	return promVector, nil
 }
+
+// QueryMetricsRange evaluates promql at every step of r.
+func (c *APIClient) QueryMetricsRange(ctx context.Context, promql string, r promapi.Range) (model.Matrix, error) {
+	var opts []promapi.Option
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, promapi.WithTimeout(time.Until(deadline)))
+	}
+	result, warnings, err := c.API.QueryRange(ctx, promql, r, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Temporal Cloud: %w", err)
+	}
+	if len(warnings) > 0 {
+		log.Printf("warning while querying Temporal Cloud range: %v\n", warnings)
+	}
+	promMatrix, ok := result.(model.Matrix)
+	if !ok {
+		log.Printf("unexpected type %T returned for range query", result)
+	}
+	return promMatrix, nil
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
+)
+
+const metricHelp = "https://docs.temporal.io/cloud/metrics#available-metrics"
+
+var (
+	querySuccessDesc = prometheus.NewDesc(
+		"promql_to_scrape_query_success",
+		"Whether the last query for the metric succeeded.",
+		[]string{"metric_name", "account"}, nil,
+	)
+	sampleAgeDesc = prometheus.NewDesc(
+		"promql_to_scrape_sample_age_seconds",
+		"Seconds since the served samples of the metric were queried.",
+		[]string{"metric_name", "account"}, nil,
+	)
+)
+
+// sampleCollector turns the samples held by the server into const metrics on every scrape.
+// It is an unchecked collector: the set of series depends entirely on what upstream returns.
+type sampleCollector struct {
+	s *PromToScrapeServer
+}
+
+func (c sampleCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c sampleCollector) Collect(ch chan<- prometheus.Metric) {
+	conf := c.s.conf.Load()
+	threshold := conf.StalenessThreshold
+
+	c.s.RLock()
+	defer c.s.RUnlock()
+
+	now := time.Now()
+	series := 0
+	for key, state := range c.s.metrics {
+		if state.lastSuccess.IsZero() || now.Sub(state.lastSuccess) >= threshold {
+			continue
+		}
+
+		metrics, err := samplesToMetrics(state.metric, state.samples, conf.Backfill.Enabled)
+		if err != nil {
+			slog.Error("dropping invalid samples", "metric", key, "error", err)
+		}
+		for _, m := range metrics {
+			ch <- m
+		}
+		series += len(metrics)
+	}
+	seriesEmitted.Set(float64(series))
+}
+
+// stateCollector describes the last refresh of every configured metric. It is served on
+// /internal/metrics with the rest of the exporter's own metrics.
+type stateCollector struct {
+	s *PromToScrapeServer
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- querySuccessDesc
+	ch <- sampleAgeDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.s.RLock()
+	defer c.s.RUnlock()
+
+	now := time.Now()
+	for _, state := range c.s.metrics {
+		success := 0.0
+		if state.lastError == nil && !state.lastSuccess.IsZero() {
+			success = 1
+		}
+		ch <- prometheus.MustNewConstMetric(querySuccessDesc, prometheus.GaugeValue, success, state.metric.MetricName, state.metric.Account)
+		if !state.lastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(sampleAgeDesc, prometheus.GaugeValue, now.Sub(state.lastSuccess).Seconds(), state.metric.MetricName, state.metric.Account)
+		}
+	}
+}
+
+// samplesToMetrics converts the samples of one configured metric into const metrics of its
+// configured type, carrying the evaluation time of the samples if withTimestamps is set.
+// Samples with invalid label names or with a label set already seen after relabeling are
+// skipped and reported in the returned error, while the rest are still converted.
+func samplesToMetrics(metric Metric, samples []*model.Sample, withTimestamps bool) ([]prometheus.Metric, error) {
+	name := metric.MetricName
+	if !model.LegacyValidation.IsValidMetricName(name) {
+		return nil, fmt.Errorf("invalid metric name %q", name)
+	}
+
+	var errs []error
+	metrics := make([]prometheus.Metric, 0, len(samples))
+	seen := make(map[model.Fingerprint]struct{}, len(samples))
+	for _, s := range samples {
+		labels := seriesLabels(metric, s.Metric)
+		fp := labels.Fingerprint()
+		if _, ok := seen[fp]; ok {
+			errs = append(errs, fmt.Errorf("duplicate series %s%s", name, labels))
+			continue
+		}
+		seen[fp] = struct{}{}
+
+		m, err := newConstMetric(metric, labels, float64(s.Value))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if withTimestamps {
+			m = prometheus.NewMetricWithTimestamp(s.Timestamp.Time(), m)
+		}
+		metrics = append(metrics, m)
+	}
+
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%d of %d samples dropped, first error: %w", len(errs), len(samples), errs[0])
+	}
+	return metrics, nil
+}
+
+// seriesLabels returns the labels of a queried series with the static labels of metric applied.
+func seriesLabels(metric Metric, m model.Metric) model.LabelSet {
+	labels := model.LabelSet(m.Clone())
+	for k, v := range metric.Labels {
+		labels[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return labels
+}
+
+func newConstMetric(metric Metric, labels model.LabelSet, value float64) (prometheus.Metric, error) {
+	name := metric.MetricName
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		if !model.LegacyValidation.IsValidLabelName(string(k)) {
+			return nil, fmt.Errorf("invalid label name %q on %s", k, name)
+		}
+		names = append(names, string(k))
+	}
+	sort.Strings(names)
+
+	values := make([]string, len(names))
+	for i, k := range names {
+		values[i] = string(labels[model.LabelName(k)])
+	}
+
+	desc := prometheus.NewDesc(name, metric.help(), names, nil)
+	return prometheus.NewConstMetric(desc, metric.valueType(), value, values...)
+}
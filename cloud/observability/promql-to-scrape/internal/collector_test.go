@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func TestSamplesToMetrics(t *testing.T) {
+	testCases := []struct {
+		name        string
+		metric      Metric
+		samples     []*model.Sample
+		wantMetrics int
+		wantErr     bool
+	}{
+		{
+			name:        "valid",
+			metric:      Metric{MetricName: "requests", Labels: map[string]string{"env": "prod"}},
+			samples:     namespaceSamples("a", "b"),
+			wantMetrics: 2,
+		},
+		{
+			name:    "malformed metric name",
+			metric:  Metric{MetricName: "requests-total"},
+			samples: namespaceSamples("a"),
+			wantErr: true,
+		},
+		{
+			name:   "malformed label name",
+			metric: Metric{MetricName: "requests"},
+			samples: append(namespaceSamples("a"), &model.Sample{
+				Metric: model.Metric{"temporal.namespace": "b"},
+			}),
+			wantMetrics: 1,
+			wantErr:     true,
+		},
+		{
+			name:        "series merged by a static label",
+			metric:      Metric{MetricName: "requests", Labels: map[string]string{"temporal_namespace": "all"}},
+			samples:     namespaceSamples("a", "b"),
+			wantMetrics: 1,
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics, err := samplesToMetrics(tc.metric, tc.samples, false)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("samplesToMetrics() error = %v, want error %t", err, tc.wantErr)
+			}
+			if len(metrics) != tc.wantMetrics {
+				t.Errorf("got %d metrics, want %d", len(metrics), tc.wantMetrics)
+			}
+		})
+	}
+}
+
+// constCollector collects a fixed set of metrics.
+type constCollector []prometheus.Metric
+
+func (c constCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+func TestExpositionDeterministic(t *testing.T) {
+	metric := Metric{MetricName: "requests", Type: MetricTypeCounter, Help: "Requests served.", Labels: map[string]string{"env": "prod"}}
+	samples := []*model.Sample{
+		{Metric: model.Metric{"temporal_namespace": "b", "operation": "poll"}, Value: 2},
+		{Metric: model.Metric{"temporal_namespace": "a", "operation": "start"}, Value: 1.5},
+		{Metric: model.Metric{"temporal_namespace": "a", "operation": "poll"}, Value: 3},
+	}
+	want := `# HELP requests Requests served.
+# TYPE requests counter
+requests{env="prod",operation="poll",temporal_namespace="a"} 3
+requests{env="prod",operation="poll",temporal_namespace="b"} 2
+requests{env="prod",operation="start",temporal_namespace="a"} 1.5
+`
+
+	for i := range samples {
+		// rotate the samples so every run sees them in a different order
+		rotated := slices.Concat(samples[i:], samples[:i])
+		metrics, err := samplesToMetrics(metric, rotated, false)
+		if err != nil {
+			t.Fatalf("samplesToMetrics() = %v", err)
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(constCollector(metrics))
+
+		rec := httptest.NewRecorder()
+		expositionHandler{registry}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if got := rec.Body.String(); got != want {
+			t.Errorf("got\n%s\nwant\n%s", got, want)
+		}
+	}
+}
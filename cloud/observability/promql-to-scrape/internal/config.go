@@ -1,36 +1,943 @@
 package internal
 
 import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/promql/parser"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultConcurrency  = 10
+	defaultQueryTimeout = 10 * time.Second
+	defaultCycleTimeout = 50 * time.Second
+	// defaultInterval is a little under a minute to provide some jitter
+	defaultInterval = 59 * time.Second
+	// defaultOffset smooths out aggregation delay upstream
+	defaultOffset = 60 * time.Second
+	// defaultBackfillMaxWindow stays inside the window Prometheus accepts samples for by default
+	defaultBackfillMaxWindow = time.Hour
+	// Push defaults follow the ones of Prometheus' remote_write queue manager.
+	defaultPushTimeout       = 30 * time.Second
+	defaultPushQueueCapacity = 100
+	defaultPushMaxRetries    = 10
+	defaultPushMinBackoff    = 30 * time.Millisecond
+	defaultPushMaxBackoff    = 5 * time.Second
+	// defaultStalenessThreshold is how long samples from the last successful query of a metric
+	// keep being served.
+	defaultStalenessThreshold = 5 * time.Minute
+	// defaultMinFreshRatio lets /metrics serve while a few queries fail, but not once most of
+	// the metrics are stale.
+	defaultMinFreshRatio = 0.5
+	// Upstream defaults stay well under what one Temporal Cloud account is allowed to query.
+	defaultUpstreamRateLimit        = 10
+	defaultUpstreamBurst            = 20
+	defaultUpstreamMaxRetries       = 3
+	defaultUpstreamMinBackoff       = 250 * time.Millisecond
+	defaultUpstreamMaxBackoff       = 10 * time.Second
+	defaultUpstreamBreakerThreshold = 5
+	defaultUpstreamBreakerCooldown  = 30 * time.Second
+	// Cache defaults
+	defaultRedisKeyPrefix = "promql-to-scrape:"
+	defaultRedisTimeout   = time.Second
+)
+
 type Config struct {
+	// Concurrency is the number of queries allowed in flight at once, across all accounts and
+	// intervals.
+	Concurrency int `yaml:"concurrency,omitempty"`
+	// QueryTimeout bounds a single query against the Prometheus API, unless the metric sets its own.
+	QueryTimeout time.Duration `yaml:"query_timeout,omitempty"`
+	// CycleTimeout bounds a whole refresh of the metrics sharing an interval. It is capped at
+	// that interval.
+	CycleTimeout time.Duration `yaml:"cycle_timeout,omitempty"`
+	// Interval is how often metrics are refreshed, unless the metric sets its own.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Offset is how far in the past queries are evaluated, unless the metric sets its own.
+	Offset *time.Duration `yaml:"offset,omitempty"`
+	// StalenessThreshold is how long the samples of a metric keep being served after its last
+	// successful query. /readyz fails once no metric has samples younger than this.
+	StalenessThreshold time.Duration `yaml:"staleness_threshold,omitempty"`
+	// MinFreshRatio is the share of configured metrics, derived ones included, that must have
+	// samples younger than StalenessThreshold for /metrics to answer 200. 0 always serves and 1
+	// requires every metric. A config without metrics is always served.
+	MinFreshRatio *float64 `yaml:"min_fresh_ratio,omitempty"`
+	// RelabelConfigs are applied to the series of every metric, before the metric's own rules.
+	// When unset, temporal_service_type is dropped.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// Backfill fills gaps left by restarts and upstream outages, see BackfillConfig.
+	Backfill BackfillConfig `yaml:"backfill,omitempty"`
+	// RemoteWrite pushes every refresh to a remote_write endpoint, in addition to serving it.
+	RemoteWrite *RemoteWriteConfig `yaml:"remote_write,omitempty"`
+	// OTLP pushes every refresh to an OpenTelemetry collector, in addition to serving it.
+	OTLP *OTLPConfig `yaml:"otlp,omitempty"`
+	// DisableMetricsEndpoint stops serving the queried series on /metrics, for deployments that
+	// only push them. It requires remote_write or otlp.
+	DisableMetricsEndpoint bool `yaml:"disable_metrics_endpoint,omitempty"`
+	// Cache shares query results between refreshes and replicas, see CacheConfig.
+	Cache *CacheConfig `yaml:"cache,omitempty"`
+	// Upstream paces the requests to each Prometheus API, see UpstreamConfig.
+	Upstream UpstreamConfig `yaml:"upstream,omitempty"`
+	// MaxSeries caps the series served across every metric, 0 for no limit. A refresh taking
+	// the total over it is handled according to SeriesLimitPolicy, the default one of metrics.
+	MaxSeries         int    `yaml:"max_series,omitempty"`
+	SeriesLimitPolicy string `yaml:"series_limit_policy,omitempty"`
+
+	// Web secures the HTTP listener.
+	Web WebConfig `yaml:"web,omitempty"`
+
+	// Accounts are upstream targets with their own connection and metrics, for exporting
+	// several Temporal Cloud accounts from one process.
+	Accounts []Account `yaml:"accounts,omitempty"`
+
+	// Metrics are queried through the endpoint given on the command line. Once the config is
+	// loaded, it also holds the metrics of every account.
 	Metrics []Metric
+	// DerivedMetrics are computed from the results of the top-level metrics. Once the config is
+	// loaded, it also holds the derived metrics of every account.
+	DerivedMetrics []DerivedMetric `yaml:"derived_metrics,omitempty"`
+}
+
+// WebConfig secures the HTTP listener. Every endpoint but /healthz and /readyz requires one of
+// the configured credentials, if any.
+type WebConfig struct {
+	// TLS serves HTTPS. Turning it on or off takes a restart, while its files are reloaded as
+	// they change.
+	TLS       *ListenerTLSConfig `yaml:"tls,omitempty"`
+	BasicAuth *BasicAuth         `yaml:"basic_auth,omitempty"`
+	// BearerToken or the content of BearerTokenFile is accepted as an Authorization: Bearer
+	// header.
+	BearerToken     string `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string `yaml:"bearer_token_file,omitempty"`
+}
+
+// ListenerTLSConfig is the server side of TLS on the listener.
+type ListenerTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile turns on mTLS: clients must present a certificate signed by one of its CAs.
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+}
+
+// BasicAuth is a single user allowed in with HTTP basic auth.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	// Password or the content of PasswordFile is the user's password.
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// AccountLabel is added to every series of an account's metrics, holding its name.
+const AccountLabel = "account"
+
+// Account is an upstream Prometheus API along with the metrics queried from it.
+type Account struct {
+	Name               string `yaml:"name"`
+	PromEndpoint       string `yaml:"prom_endpoint"`
+	ClientCert         string `yaml:"client_cert,omitempty"`
+	ClientKey          string `yaml:"client_key,omitempty"`
+	ServerRootCACert   string `yaml:"server_root_ca_cert,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	// BearerTokenFile and BearerTokenEnv authenticate with an API key instead of, or on top
+	// of, a client cert.
+	BearerTokenFile string           `yaml:"bearer_token_file,omitempty"`
+	BearerTokenEnv  string           `yaml:"bearer_token_env,omitempty"`
+	BasicAuth       *ClientBasicAuth `yaml:"basic_auth,omitempty"`
+
+	Metrics []Metric `yaml:"metrics"`
+	// DerivedMetrics are computed from the results of the account's metrics.
+	DerivedMetrics []DerivedMetric `yaml:"derived_metrics,omitempty"`
+}
+
+// ClientBasicAuth is the basic auth sent to an upstream Prometheus API. The password is read
+// from a file or an environment variable, never from the config itself.
+type ClientBasicAuth struct {
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+	PasswordEnv  string `yaml:"password_env,omitempty"`
+}
+
+func (a Account) apiConfig() APIConfig {
+	cfg := APIConfig{
+		TargetHost:         a.PromEndpoint,
+		ServerRootCACert:   a.ServerRootCACert,
+		ClientCert:         a.ClientCert,
+		ClientKey:          a.ClientKey,
+		ServerName:         a.ServerName,
+		InsecureSkipVerify: a.InsecureSkipVerify,
+	}
+	cfg.BearerTokenFile, cfg.BearerTokenEnv = a.BearerTokenFile, a.BearerTokenEnv
+	if a.BasicAuth != nil {
+		cfg.BasicAuthUsername = a.BasicAuth.Username
+		cfg.BasicAuthPasswordFile = a.BasicAuth.PasswordFile
+		cfg.BasicAuthPasswordEnv = a.BasicAuth.PasswordEnv
+	}
+	return cfg
+}
+
+// BackfillConfig turns on serving samples with explicit timestamps. When a metric has not been
+// refreshed for more than one and a half intervals, the missed window is filled with a range
+// query and those points are served ahead of the live sample until the next refresh.
+type BackfillConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// StateFile remembers when each metric was last evaluated, so gaps spanning a restart can be
+	// filled. Without it only gaps from failed refreshes within one process are filled.
+	StateFile string `yaml:"state_file,omitempty"`
+	// MaxWindow caps how far back a gap is filled.
+	MaxWindow time.Duration `yaml:"max_window,omitempty"`
+}
+
+// UpstreamConfig paces the requests sent to a Prometheus API. The endpoint given on the
+// command line and every account get their own rate limit and circuit breaker.
+type UpstreamConfig struct {
+	// RateLimit is how many requests per second are sent, with bursts of up to Burst. A
+	// negative value turns the limit off.
+	RateLimit float64 `yaml:"rate_limit,omitempty"`
+	Burst     int     `yaml:"burst,omitempty"`
+	// MaxRetries is how many times a request timing out, losing its connection or answered
+	// with a 429, 502, 503 or 504 is retried. Retries wait MinBackoff, doubling up to MaxBackoff, or as long as the
+	// Retry-After header asks.
+	MaxRetries int           `yaml:"max_retries,omitempty"`
+	MinBackoff time.Duration `yaml:"min_backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+	// BreakerThreshold is how many requests in a row may fail, after retries, before querying
+	// pauses for BreakerCooldown. A single request is then let through to probe the endpoint.
+	BreakerThreshold int           `yaml:"breaker_threshold,omitempty"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown,omitempty"`
+}
+
+// Cache types accepted in the config.
+const (
+	CacheTypeMemory = "memory"
+	CacheTypeFile   = "file"
+	CacheTypeRedis  = "redis"
+)
+
+// CacheConfig turns on caching of query results keyed by query and evaluation time. Evaluation
+// times are aligned down to a multiple of Align, so replicas evaluate a query at the same
+// times and reuse each other's results through a shared file or Redis cache.
+type CacheConfig struct {
+	// Type is memory (the default), file or redis.
+	Type string `yaml:"type,omitempty"`
+	// Align defaults to the interval of each metric.
+	Align time.Duration `yaml:"align,omitempty"`
+	// Directory holds the entries of a file cache, eg. on a volume shared by replicas.
+	Directory string `yaml:"directory,omitempty"`
+	// Redis is the server of a redis cache. Any server speaking the Redis protocol works.
+	Redis RedisConfig `yaml:"redis,omitempty"`
+}
+
+// RedisConfig is how to reach a Redis compatible server.
+type RedisConfig struct {
+	Address      string        `yaml:"address,omitempty"`
+	Username     string        `yaml:"username,omitempty"`
+	PasswordFile string        `yaml:"password_file,omitempty"`
+	DB           int           `yaml:"db,omitempty"`
+	KeyPrefix    string        `yaml:"key_prefix,omitempty"`
+	Timeout      time.Duration `yaml:"timeout,omitempty"`
+}
+
+// align is the alignment of the evaluation times of metric.
+func (c *CacheConfig) align(metric Metric) time.Duration {
+	if c.Align > 0 {
+		return c.Align
+	}
+	return metric.Interval
+}
+
+func (c *CacheConfig) validate() error {
+	switch c.Type {
+	case CacheTypeMemory:
+	case CacheTypeFile:
+		if c.Directory == "" {
+			return fmt.Errorf("a file cache needs a directory")
+		}
+	case CacheTypeRedis:
+		if _, _, err := net.SplitHostPort(c.Redis.Address); err != nil {
+			return fmt.Errorf("a redis cache needs an address as host:port, got %q", c.Redis.Address)
+		}
+		if c.Redis.DB < 0 || c.Redis.Timeout < 0 {
+			return fmt.Errorf("redis db and timeout must be positive")
+		}
+	default:
+		return fmt.Errorf("unsupported type %q, must be memory, file or redis", c.Type)
+	}
+	if c.Align < 0 {
+		return fmt.Errorf("align must be positive")
+	}
+	return nil
+}
+
+// evalTime is the time metric is evaluated at for a refresh at now. With a cache, it is
+// aligned down to the cache alignment so that replicas evaluate, and share, the same times.
+func (c *Config) evalTime(metric Metric, now time.Time) time.Time {
+	ts := now.Add(-*metric.Offset)
+	if c.Cache != nil {
+		ts = ts.Truncate(c.Cache.align(metric))
+	}
+	return ts
+}
+
+// RemoteWriteConfig is where and how refreshed samples are pushed with the Prometheus
+// remote_write protocol.
+type RemoteWriteConfig struct {
+	URL        string `yaml:"url"`
+	PushConfig `yaml:",inline"`
+}
+
+// OTLPConfig is where and how refreshed samples are pushed as OTLP metrics.
+type OTLPConfig struct {
+	// Endpoint is host:port for gRPC, or the full URL of the metrics path for HTTP, eg.
+	// http://otel-collector:4318/v1/metrics.
+	Endpoint string `yaml:"endpoint"`
+	// Protocol is grpc (the default) or http/protobuf.
+	Protocol string `yaml:"protocol,omitempty"`
+	// Insecure turns off TLS for gRPC. For HTTP the URL scheme decides.
+	Insecure bool `yaml:"insecure,omitempty"`
+	// ResourceLabels are moved from the data points to the resource attributes, grouping the
+	// series sharing their values under one resource.
+	ResourceLabels []string `yaml:"resource_labels,omitempty"`
+	PushConfig     `yaml:",inline"`
+}
+
+// OTLP protocols accepted in the config.
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http/protobuf"
+)
+
+// PushConfig is shared by the push targets.
+type PushConfig struct {
+	// Headers are added to every request, eg. X-Scope-OrgID for Mimir and Cortex tenants.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Timeout bounds a single push attempt.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// QueueCapacity is how many refreshes are kept while the target is unavailable. Once it is
+	// full the oldest refresh is dropped. Changes take effect on restart.
+	QueueCapacity int `yaml:"queue_capacity,omitempty"`
+	// MaxRetries is how many times a push failing with a retryable error is retried before it
+	// is dropped.
+	MaxRetries int `yaml:"max_retries,omitempty"`
+	// MinBackoff is the delay before the first retry, doubling on every retry up to MaxBackoff.
+	MinBackoff time.Duration `yaml:"min_backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
 }
 
 type Metric struct {
 	MetricName string `yaml:"metric_name"`
 	Query      string `yaml:"query"`
+	// Type is the metric type reported downstream: gauge (the default), counter or untyped.
+	Type string `yaml:"type,omitempty"`
+	// Help replaces the default HELP text pointing at the Temporal Cloud metrics docs.
+	Help string `yaml:"help,omitempty"`
+	// Unit is reported in OpenMetrics output and must be a suffix of MetricName, eg. seconds.
+	Unit string `yaml:"unit,omitempty"`
+	// Labels are added to every series of the metric, replacing queried labels of the same name.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// RelabelConfigs are applied to the series of this metric after the global ones.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+	// Interval, Offset and Timeout override the global interval, offset and query_timeout.
+	// They are always set once the config is loaded.
+	Interval time.Duration  `yaml:"interval,omitempty"`
+	Offset   *time.Duration `yaml:"offset,omitempty"`
+	Timeout  time.Duration  `yaml:"timeout,omitempty"`
+	// MaxSeries caps the series of the metric after relabeling, 0 for no limit. Going over it
+	// is handled according to SeriesLimitPolicy, which defaults to the global one.
+	MaxSeries         int    `yaml:"max_series,omitempty"`
+	SeriesLimitPolicy string `yaml:"series_limit_policy,omitempty"`
+
+	// Account is the name of the account the metric belongs to, empty for top-level metrics.
+	Account string `yaml:"-"`
 }
 
-func LoadConfig(filename string) (*Config, error) {
-	var config Config
+// DerivedMetric is computed in-process from the results of other metrics, like a recording
+// rule, so ratios and sums cost no extra upstream queries. Expr is PromQL restricted to
+// numbers, arithmetic operators and the names of the metrics configured alongside it, whose
+// series are matched on labels as in PromQL, including on, ignoring, group_left and
+// group_right.
+type DerivedMetric struct {
+	MetricName string `yaml:"metric_name"`
+	Expr       string `yaml:"expr"`
+	// Type, Help, Unit and Labels are as for Metric.
+	Type   string            `yaml:"type,omitempty"`
+	Help   string            `yaml:"help,omitempty"`
+	Unit   string            `yaml:"unit,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// Account is the name of the account the metric belongs to, empty for top-level metrics.
+	Account string `yaml:"-"`
+	// expr is Expr, parsed once the config is validated.
+	expr parser.Expr
+}
+
+// metric returns the Metric the derived metric is served and pushed as, with its expression
+// as the query.
+func (d DerivedMetric) metric() Metric {
+	return Metric{
+		MetricName: d.MetricName,
+		Query:      d.Expr,
+		Type:       d.Type,
+		Help:       d.Help,
+		Unit:       d.Unit,
+		Labels:     d.Labels,
+		Account:    d.Account,
+	}
+}
+
+// key identifies the metric among the metrics of every account.
+func (m Metric) key() string {
+	if m.Account == "" {
+		return m.MetricName
+	}
+	return m.Account + "/" + m.MetricName
+}
+
+// Series limit policies accepted in the config.
+const (
+	// SeriesLimitTruncate keeps the first series in label order, up to the limit.
+	SeriesLimitTruncate = "truncate"
+	// SeriesLimitReject fails the refresh of the metric, which keeps serving its last samples
+	// within the limit until they go stale.
+	SeriesLimitReject = "reject"
+)
+
+// Metric types accepted in the config.
+const (
+	MetricTypeGauge   = "gauge"
+	MetricTypeCounter = "counter"
+	MetricTypeUntyped = "untyped"
+)
+
+var unitRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 
+func LoadConfig(filename string) (*Config, error) {
 	bytes, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	err = yaml.Unmarshal(bytes, &config)
+	return ParseConfig(bytes)
+}
+
+// ParseConfig parses and validates a YAML config, filling in defaults for unset fields.
+func ParseConfig(bytes []byte) (*Config, error) {
+	var config Config
+
+	err := yaml.Unmarshal(bytes, &config)
 	if err != nil {
 		return nil, err
 	}
 
+	config.applyDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+func (c *Config) applyDefaults() {
+	if c.Concurrency == 0 {
+		c.Concurrency = defaultConcurrency
+	}
+	if c.QueryTimeout == 0 {
+		c.QueryTimeout = defaultQueryTimeout
+	}
+	if c.CycleTimeout == 0 {
+		c.CycleTimeout = defaultCycleTimeout
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+	if c.Offset == nil {
+		offset := defaultOffset
+		c.Offset = &offset
+	}
+	for _, account := range c.Accounts {
+		for _, m := range account.Metrics {
+			m.Account = account.Name
+			m.Labels = withAccountLabel(m.Labels, account.Name)
+			c.Metrics = append(c.Metrics, m)
+		}
+		for _, d := range account.DerivedMetrics {
+			d.Account = account.Name
+			d.Labels = withAccountLabel(d.Labels, account.Name)
+			c.DerivedMetrics = append(c.DerivedMetrics, d)
+		}
+	}
+	if c.SeriesLimitPolicy == "" {
+		c.SeriesLimitPolicy = SeriesLimitTruncate
+	}
+	for i := range c.Metrics {
+		m := &c.Metrics[i]
+		if m.SeriesLimitPolicy == "" {
+			m.SeriesLimitPolicy = c.SeriesLimitPolicy
+		}
+		if m.Interval == 0 {
+			m.Interval = c.Interval
+		}
+		if m.Offset == nil {
+			m.Offset = c.Offset
+		}
+		if m.Timeout == 0 {
+			m.Timeout = c.QueryTimeout
+		}
+	}
+	if c.StalenessThreshold == 0 {
+		c.StalenessThreshold = defaultStalenessThreshold
+	}
+	if c.MinFreshRatio == nil {
+		ratio := defaultMinFreshRatio
+		c.MinFreshRatio = &ratio
+	}
+	if c.RelabelConfigs == nil {
+		c.RelabelConfigs = defaultRelabelConfigs
+	}
+	if c.Backfill.MaxWindow == 0 {
+		c.Backfill.MaxWindow = defaultBackfillMaxWindow
+	}
+	if c.RemoteWrite != nil {
+		c.RemoteWrite.applyDefaults()
+	}
+	if c.OTLP != nil {
+		if c.OTLP.Protocol == "" {
+			c.OTLP.Protocol = OTLPProtocolGRPC
+		}
+		c.OTLP.applyDefaults()
+	}
+	c.Upstream.applyDefaults()
+	if c.Cache != nil {
+		if c.Cache.Type == "" {
+			c.Cache.Type = CacheTypeMemory
+		}
+		if c.Cache.Redis.KeyPrefix == "" {
+			c.Cache.Redis.KeyPrefix = defaultRedisKeyPrefix
+		}
+		if c.Cache.Redis.Timeout == 0 {
+			c.Cache.Redis.Timeout = defaultRedisTimeout
+		}
+	}
+}
+
+func (p *PushConfig) applyDefaults() {
+	if p.Timeout == 0 {
+		p.Timeout = defaultPushTimeout
+	}
+	if p.QueueCapacity == 0 {
+		p.QueueCapacity = defaultPushQueueCapacity
+	}
+	if p.MaxRetries == 0 {
+		p.MaxRetries = defaultPushMaxRetries
+	}
+	if p.MinBackoff == 0 {
+		p.MinBackoff = defaultPushMinBackoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = defaultPushMaxBackoff
+	}
+}
+
+// withAccountLabel returns a copy of labels with the account label set to account.
+func withAccountLabel(labels map[string]string, account string) map[string]string {
+	withAccount := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		withAccount[k] = v
+	}
+	withAccount[AccountLabel] = account
+	return withAccount
+}
+
+func (u *UpstreamConfig) applyDefaults() {
+	if u.RateLimit == 0 {
+		u.RateLimit = defaultUpstreamRateLimit
+	}
+	if u.Burst == 0 {
+		u.Burst = defaultUpstreamBurst
+	}
+	if u.MaxRetries == 0 {
+		u.MaxRetries = defaultUpstreamMaxRetries
+	}
+	if u.MinBackoff == 0 {
+		u.MinBackoff = defaultUpstreamMinBackoff
+	}
+	if u.MaxBackoff == 0 {
+		u.MaxBackoff = defaultUpstreamMaxBackoff
+	}
+	if u.BreakerThreshold == 0 {
+		u.BreakerThreshold = defaultUpstreamBreakerThreshold
+	}
+	if u.BreakerCooldown == 0 {
+		u.BreakerCooldown = defaultUpstreamBreakerCooldown
+	}
+}
+
+func (c *Config) validate() error {
+	if c.Concurrency < 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", c.Concurrency)
+	}
+	if c.QueryTimeout < 0 || c.CycleTimeout < 0 || c.StalenessThreshold < 0 || c.Interval < 0 || *c.Offset < 0 {
+		return fmt.Errorf("query_timeout, cycle_timeout, staleness_threshold, interval and offset must be positive")
+	}
+	if *c.MinFreshRatio < 0 || *c.MinFreshRatio > 1 {
+		return fmt.Errorf("min_fresh_ratio must be between 0 and 1, got %v", *c.MinFreshRatio)
+	}
+
+	if c.Backfill.MaxWindow < 0 {
+		return fmt.Errorf("backfill max_window must be positive")
+	}
+
+	if rw := c.RemoteWrite; rw != nil {
+		if !isHTTPURL(rw.URL) {
+			return fmt.Errorf("remote_write url must be an absolute http or https URL, got %q", rw.URL)
+		}
+		if err := rw.validate(); err != nil {
+			return fmt.Errorf("invalid remote_write: %w", err)
+		}
+	}
+	if o := c.OTLP; o != nil {
+		switch o.Protocol {
+		case OTLPProtocolGRPC:
+			if _, _, err := net.SplitHostPort(o.Endpoint); err != nil {
+				return fmt.Errorf("otlp endpoint must be host:port for grpc, got %q", o.Endpoint)
+			}
+		case OTLPProtocolHTTP:
+			if !isHTTPURL(o.Endpoint) {
+				return fmt.Errorf("otlp endpoint must be an absolute http or https URL for http/protobuf, got %q", o.Endpoint)
+			}
+		default:
+			return fmt.Errorf("otlp has unsupported protocol %q, must be grpc or http/protobuf", o.Protocol)
+		}
+		for _, name := range o.ResourceLabels {
+			if !model.LegacyValidation.IsValidLabelName(name) {
+				return fmt.Errorf("otlp has invalid resource label %q", name)
+			}
+		}
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("invalid otlp: %w", err)
+		}
+	}
+
+	if c.DisableMetricsEndpoint && c.RemoteWrite == nil && c.OTLP == nil {
+		return fmt.Errorf("disable_metrics_endpoint requires remote_write or otlp, or nothing would export the metrics")
+	}
+
+	if c.Cache != nil {
+		if err := c.Cache.validate(); err != nil {
+			return fmt.Errorf("invalid cache: %w", err)
+		}
+	}
+	if err := c.Upstream.validate(); err != nil {
+		return err
+	}
+	if c.MaxSeries < 0 {
+		return fmt.Errorf("max_series must be positive, got %d", c.MaxSeries)
+	}
+	if err := validateSeriesLimitPolicy(c.SeriesLimitPolicy); err != nil {
+		return err
+	}
+
+	if err := validateRelabelConfigs(c.RelabelConfigs); err != nil {
+		return fmt.Errorf("invalid global relabel_configs: %w", err)
+	}
+
+	if err := c.Web.validate(); err != nil {
+		return fmt.Errorf("invalid web: %w", err)
+	}
+
+	if err := c.validateAccounts(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]struct{}, len(c.Metrics))
+	families := make(map[string]Metric, len(c.Metrics))
+	for _, metric := range c.Metrics {
+		if err := metric.validate(); err != nil {
+			return err
+		}
+		if metric.Interval >= c.StalenessThreshold {
+			return fmt.Errorf("metric %q has interval %s, which must be shorter than staleness_threshold (%s)", metric.MetricName, metric.Interval, c.StalenessThreshold)
+		}
+		if metric.Timeout > min(metric.Interval, c.CycleTimeout) {
+			return fmt.Errorf("metric %q has timeout %s, which must not exceed its interval or cycle_timeout", metric.MetricName, metric.Timeout)
+		}
+		if _, ok := seen[metric.key()]; ok {
+			if metric.Account != "" {
+				return fmt.Errorf("metric_name %q is configured more than once in account %q", metric.MetricName, metric.Account)
+			}
+			return fmt.Errorf("metric_name %q is configured more than once", metric.MetricName)
+		}
+		seen[metric.key()] = struct{}{}
+		// the series of every account end up in one family, which has a single type, help and unit
+		if other, ok := families[metric.MetricName]; ok && (other.Type != metric.Type || other.Help != metric.Help || other.Unit != metric.Unit) {
+			return fmt.Errorf("metric_name %q must have the same type, help and unit wherever it is configured", metric.MetricName)
+		}
+		families[metric.MetricName] = metric
+	}
+
+	queried := maps.Clone(seen)
+	for i := range c.DerivedMetrics {
+		d := &c.DerivedMetrics[i]
+		if d.Expr == "" {
+			return fmt.Errorf("derived metric %q has no expr", d.MetricName)
+		}
+		metric := d.metric()
+		if err := metric.validate(); err != nil {
+			return err
+		}
+		if _, ok := seen[metric.key()]; ok {
+			return fmt.Errorf("metric_name %q is configured more than once", metric.key())
+		}
+		seen[metric.key()] = struct{}{}
+		if other, ok := families[metric.MetricName]; ok && (other.Type != metric.Type || other.Help != metric.Help || other.Unit != metric.Unit) {
+			return fmt.Errorf("metric_name %q must have the same type, help and unit wherever it is configured", metric.MetricName)
+		}
+		families[metric.MetricName] = metric
+
+		expr, err := parseDerivedExpr(d.Expr, func(name string) bool {
+			_, ok := queried[Metric{MetricName: name, Account: d.Account}.key()]
+			return ok
+		})
+		if err != nil {
+			return fmt.Errorf("derived metric %q has invalid expr: %w", metric.key(), err)
+		}
+		d.expr = expr
+	}
+	return nil
+}
+
+func (w WebConfig) validate() error {
+	if w.TLS != nil && (w.TLS.CertFile == "" || w.TLS.KeyFile == "") {
+		return fmt.Errorf("tls needs a cert_file and key_file")
+	}
+	if b := w.BasicAuth; b != nil {
+		if b.Username == "" {
+			return fmt.Errorf("basic_auth needs a username")
+		}
+		if (b.Password == "") == (b.PasswordFile == "") {
+			return fmt.Errorf("basic_auth needs exactly one of password and password_file")
+		}
+	}
+	if w.BearerToken != "" && w.BearerTokenFile != "" {
+		return fmt.Errorf("at most one of bearer_token and bearer_token_file can be set")
+	}
+	return nil
+}
+
+func (c *Config) validateAccounts() error {
+	names := make(map[string]struct{}, len(c.Accounts))
+	for _, account := range c.Accounts {
+		if account.Name == "" {
+			return fmt.Errorf("every account needs a name")
+		}
+		if _, ok := names[account.Name]; ok {
+			return fmt.Errorf("account %q is configured more than once", account.Name)
+		}
+		names[account.Name] = struct{}{}
+
+		if !isHTTPURL(account.PromEndpoint) {
+			return fmt.Errorf("account %q must have an absolute http or https prom_endpoint, got %q", account.Name, account.PromEndpoint)
+		}
+		if account.BasicAuth != nil && account.BasicAuth.Username == "" {
+			return fmt.Errorf("account %q must have a basic_auth username", account.Name)
+		}
+		if err := account.apiConfig().validateAuth(); err != nil {
+			return fmt.Errorf("account %q: %w", account.Name, err)
+		}
+		for _, metric := range account.Metrics {
+			if _, ok := metric.Labels[AccountLabel]; ok {
+				return fmt.Errorf("metric %q of account %q must not set the %s label, it is set to the account name", metric.MetricName, account.Name, AccountLabel)
+			}
+		}
+		for _, d := range account.DerivedMetrics {
+			if _, ok := d.Labels[AccountLabel]; ok {
+				return fmt.Errorf("derived metric %q of account %q must not set the %s label, it is set to the account name", d.MetricName, account.Name, AccountLabel)
+			}
+		}
+	}
+	return nil
+}
+
+// account returns the account named name.
+func (c *Config) account(name string) (Account, bool) {
+	for _, account := range c.Accounts {
+		if account.Name == name {
+			return account, true
+		}
+	}
+	return Account{}, false
+}
+
+func (u UpstreamConfig) validate() error {
+	if u.Burst < 0 || u.MaxRetries < 0 || u.MinBackoff < 0 || u.MaxBackoff < 0 || u.BreakerThreshold < 0 || u.BreakerCooldown < 0 {
+		return fmt.Errorf("upstream settings must be positive")
+	}
+	if u.MinBackoff > u.MaxBackoff {
+		return fmt.Errorf("upstream min_backoff must not exceed max_backoff")
+	}
+	return nil
+}
+
+func (p PushConfig) validate() error {
+	if p.Timeout < 0 || p.QueueCapacity < 0 || p.MaxRetries < 0 || p.MinBackoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("timeout, queue_capacity, max_retries, min_backoff and max_backoff must be positive")
+	}
+	if p.MinBackoff > p.MaxBackoff {
+		return fmt.Errorf("min_backoff must not exceed max_backoff")
+	}
+	return nil
+}
+
+func validateSeriesLimitPolicy(policy string) error {
+	switch policy {
+	case "", SeriesLimitTruncate, SeriesLimitReject:
+		return nil
+	default:
+		return fmt.Errorf("unsupported series_limit_policy %q, must be truncate or reject", policy)
+	}
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (m Metric) validate() error {
+	if !model.LegacyValidation.IsValidMetricName(m.MetricName) {
+		return fmt.Errorf("invalid metric_name %q", m.MetricName)
+	}
+	if m.Query == "" {
+		return fmt.Errorf("metric %q has no query", m.MetricName)
+	}
+	if m.Interval < 0 || m.Timeout < 0 || (m.Offset != nil && *m.Offset < 0) {
+		return fmt.Errorf("metric %q must have positive interval, offset and timeout", m.MetricName)
+	}
+
+	switch m.Type {
+	case "", MetricTypeGauge, MetricTypeCounter, MetricTypeUntyped:
+	default:
+		return fmt.Errorf("metric %q has unsupported type %q, must be one of gauge, counter or untyped", m.MetricName, m.Type)
+	}
+
+	if m.MaxSeries < 0 {
+		return fmt.Errorf("metric %q must have a positive max_series, got %d", m.MetricName, m.MaxSeries)
+	}
+	if err := validateSeriesLimitPolicy(m.SeriesLimitPolicy); err != nil {
+		return fmt.Errorf("metric %q: %w", m.MetricName, err)
+	}
+
+	if m.Unit != "" {
+		if !unitRegexp.MatchString(m.Unit) {
+			return fmt.Errorf("metric %q has invalid unit %q", m.MetricName, m.Unit)
+		}
+		name := strings.TrimSuffix(m.MetricName, "_total")
+		if !strings.HasSuffix(name, "_"+m.Unit) {
+			return fmt.Errorf("metric %q must end with its unit %q", m.MetricName, "_"+m.Unit)
+		}
+	}
+
+	for name := range m.Labels {
+		if !model.LegacyValidation.IsValidLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("metric %q has invalid label name %q", m.MetricName, name)
+		}
+	}
+
+	if err := validateRelabelConfigs(m.RelabelConfigs); err != nil {
+		return fmt.Errorf("metric %q has invalid relabel_configs: %w", m.MetricName, err)
+	}
+	return nil
+}
+
+func validateRelabelConfigs(cfgs []*relabel.Config) error {
+	for i, cfg := range cfgs {
+		if cfg == nil {
+			return fmt.Errorf("rule %d is empty", i)
+		}
+		if err := cfg.Validate(model.LegacyValidation); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// groupKey identifies metrics refreshed together: from the same account on the same cadence.
+type groupKey struct {
+	account  string
+	interval time.Duration
+}
+
+func (k groupKey) String() string {
+	if k.account == "" {
+		return fmt.Sprintf("metrics every %s", model.Duration(k.interval))
+	}
+	return fmt.Sprintf("account %q every %s", k.account, model.Duration(k.interval))
+}
+
+// compareGroupKeys orders groups by account, then interval.
+func compareGroupKeys(a, b groupKey) int {
+	return cmp.Or(strings.Compare(a.account, b.account), cmp.Compare(a.interval, b.interval))
+}
+
+// groupBySchedule splits the configured metrics into groups refreshed together.
+func (c *Config) groupBySchedule() map[groupKey][]Metric {
+	groups := map[groupKey][]Metric{}
+	for _, metric := range c.Metrics {
+		key := groupKey{account: metric.Account, interval: metric.Interval}
+		groups[key] = append(groups[key], metric)
+	}
+	return groups
+}
+
+// group returns the config refreshing metrics, the group of c identified by key. A refresh of
+// the group must finish within its interval.
+func (c *Config) group(key groupKey, metrics []Metric) *Config {
+	group := *c
+	group.Metrics = metrics
+	group.CycleTimeout = min(c.CycleTimeout, key.interval)
+	return &group
+}
+
+func (m Metric) valueType() prometheus.ValueType {
+	switch m.Type {
+	case MetricTypeCounter:
+		return prometheus.CounterValue
+	case MetricTypeUntyped:
+		return prometheus.UntypedValue
+	default:
+		return prometheus.GaugeValue
+	}
+}
+
+func (m Metric) dtoType() *dto.MetricType {
+	switch m.Type {
+	case MetricTypeCounter:
+		return dto.MetricType_COUNTER.Enum()
+	case MetricTypeUntyped:
+		return dto.MetricType_UNTYPED.Enum()
+	default:
+		return dto.MetricType_GAUGE.Enum()
+	}
+}
+
+func (m Metric) help() string {
+	if m.Help != "" {
+		return m.Help
+	}
+	return metricHelp
+}
+
 // ByMetricName lets us sort metrics
 type ByMetricName []Metric
 
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const accountsConfig = `
+accounts:
+  - name: prod
+    prom_endpoint: https://prod.tmprl.cloud/prometheus
+    client_cert: prod.crt
+    client_key: prod.key
+    metrics:
+      - metric_name: temporal_cloud_v0_poll_success_count
+        query: temporal_cloud_v0_poll_success_count
+        labels:
+          team: payments
+  - name: staging
+    prom_endpoint: https://staging.tmprl.cloud/prometheus
+    client_cert: staging.crt
+    client_key: staging.key
+    metrics:
+      - metric_name: temporal_cloud_v0_poll_success_count
+        query: temporal_cloud_v0_poll_success_count
+`
+
+func TestParseConfigAccounts(t *testing.T) {
+	conf, err := ParseConfig([]byte(accountsConfig))
+	if err != nil {
+		t.Fatalf("ParseConfig() = %v", err)
+	}
+	if len(conf.Metrics) != 2 {
+		t.Fatalf("got %d metrics, want the metrics of both accounts", len(conf.Metrics))
+	}
+	prod := conf.Metrics[0]
+	if prod.key() != "prod/temporal_cloud_v0_poll_success_count" || prod.Labels[AccountLabel] != "prod" || prod.Labels["team"] != "payments" {
+		t.Errorf("got metric %+v, want it keyed and labeled with its account", prod)
+	}
+	if prod.Interval != defaultInterval {
+		t.Errorf("got interval %s, want the default %s", prod.Interval, defaultInterval)
+	}
+	if _, ok := conf.Accounts[0].Metrics[0].Labels[AccountLabel]; ok {
+		t.Error("account label leaked into the account's own metric list")
+	}
+	if groups := conf.groupBySchedule(); len(groups) != 2 {
+		t.Errorf("got %d groups, want one per account", len(groups))
+	}
+}
+
+func TestGroupBySchedule(t *testing.T) {
+	conf, err := ParseConfig([]byte(accountsConfig + `
+        interval: 30s
+metrics:
+  - metric_name: a
+    query: a
+  - metric_name: b
+    query: b
+    interval: 30s
+  - metric_name: c
+    query: c
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() = %v", err)
+	}
+
+	want := map[groupKey][]string{
+		{interval: defaultInterval}:                      {"a", "c"},
+		{interval: 30 * time.Second}:                     {"b"},
+		{account: "prod", interval: defaultInterval}:     {"prod/temporal_cloud_v0_poll_success_count"},
+		{account: "staging", interval: 30 * time.Second}: {"staging/temporal_cloud_v0_poll_success_count"},
+	}
+	groups := conf.groupBySchedule()
+	if len(groups) != len(want) {
+		t.Errorf("got %d groups, want %d", len(groups), len(want))
+	}
+	for key, keys := range want {
+		var got []string
+		for _, metric := range groups[key] {
+			got = append(got, metric.key())
+		}
+		if !slices.Equal(got, keys) {
+			t.Errorf("group %s has metrics %q, want %q", key, got, keys)
+		}
+	}
+}
+
+func TestParseConfigAccountsInvalid(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "duplicate account",
+			config:  strings.Replace(accountsConfig, "name: staging", "name: prod", 1),
+			wantErr: `account "prod" is configured more than once`,
+		},
+		{
+			name:    "missing endpoint",
+			config:  strings.Replace(accountsConfig, "prom_endpoint: https://prod.tmprl.cloud/prometheus", "", 1),
+			wantErr: "prom_endpoint",
+		},
+		{
+			name:    "account label set by hand",
+			config:  strings.Replace(accountsConfig, "team: payments", "account: other", 1),
+			wantErr: "must not set the account label",
+		},
+		{
+			name:    "conflicting types across accounts",
+			config:  accountsConfig + "        type: counter\n",
+			wantErr: "must have the same type, help and unit",
+		},
+		{
+			name:    "derived metric named like a queried one",
+			config:  accountsConfig + "    derived_metrics:\n      - metric_name: temporal_cloud_v0_poll_success_count\n        expr: temporal_cloud_v0_poll_success_count * 2\n",
+			wantErr: `"staging/temporal_cloud_v0_poll_success_count" is configured more than once`,
+		},
+		{
+			name:    "top-level derived metric over an account's metric",
+			config:  accountsConfig + "derived_metrics:\n  - metric_name: doubled\n    expr: temporal_cloud_v0_poll_success_count * 2\n",
+			wantErr: "not a configured metric",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tc.config))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ParseConfig() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetricValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		metric  Metric
+		wantErr string
+	}{
+		{
+			name:   "full metadata",
+			metric: Metric{MetricName: "poll_latency_seconds_total", Query: "q", Type: MetricTypeCounter, Help: "Poll latency.", Unit: "seconds", Labels: map[string]string{"team": "payments"}},
+		},
+		{
+			name:   "defaults",
+			metric: Metric{MetricName: "poll_success", Query: "q"},
+		},
+		{
+			name:    "unsupported type",
+			metric:  Metric{MetricName: "poll_latency", Query: "q", Type: "histogram"},
+			wantErr: `unsupported type "histogram"`,
+		},
+		{
+			name:    "malformed unit",
+			metric:  Metric{MetricName: "poll_latency_seconds", Query: "q", Unit: "sec onds"},
+			wantErr: `invalid unit "sec onds"`,
+		},
+		{
+			name:    "name without its unit",
+			metric:  Metric{MetricName: "poll_latency", Query: "q", Unit: "seconds"},
+			wantErr: `must end with its unit "_seconds"`,
+		},
+		{
+			name:    "malformed label name",
+			metric:  Metric{MetricName: "poll_latency", Query: "q", Labels: map[string]string{"team-name": "payments"}},
+			wantErr: `invalid label name "team-name"`,
+		},
+		{
+			name:    "reserved label name",
+			metric:  Metric{MetricName: "poll_latency", Query: "q", Labels: map[string]string{"__name__": "other"}},
+			wantErr: `invalid label name "__name__"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.metric.validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("validate() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
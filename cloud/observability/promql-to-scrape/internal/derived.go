@@ -0,0 +1,310 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/exp/slog"
+)
+
+// parseDerivedExpr parses the expression of a derived metric, checking that it only does
+// arithmetic over numbers and the metrics for which known returns true.
+func parseDerivedExpr(expr string, known func(name string) bool) (parser.Expr, error) {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDerivedExpr(e, known); err != nil {
+		return nil, err
+	}
+	if e.Type() != parser.ValueTypeVector {
+		return nil, errors.New("must refer to at least one metric")
+	}
+	return e, nil
+}
+
+func checkDerivedExpr(e parser.Expr, known func(name string) bool) error {
+	switch e := e.(type) {
+	case *parser.NumberLiteral:
+		return nil
+	case *parser.ParenExpr:
+		return checkDerivedExpr(e.Expr, known)
+	case *parser.UnaryExpr:
+		return checkDerivedExpr(e.Expr, known)
+	case *parser.VectorSelector:
+		if e.Name == "" || len(e.LabelMatchers) != 1 || e.OriginalOffset != 0 || e.Timestamp != nil || e.StartOrEnd != 0 {
+			return fmt.Errorf("%s must be a bare metric name", e)
+		}
+		if !known(e.Name) {
+			return fmt.Errorf("%q is not a configured metric", e.Name)
+		}
+		return nil
+	case *parser.BinaryExpr:
+		switch e.Op {
+		case parser.ADD, parser.SUB, parser.MUL, parser.DIV, parser.MOD, parser.POW:
+		default:
+			return fmt.Errorf("operator %s is not supported, only + - * / %% ^", e.Op)
+		}
+		if err := checkDerivedExpr(e.LHS, known); err != nil {
+			return err
+		}
+		return checkDerivedExpr(e.RHS, known)
+	default:
+		return fmt.Errorf("%s is not supported, only arithmetic over configured metrics", e)
+	}
+}
+
+// derivedInputs returns the names of the metrics expr refers to.
+func derivedInputs(expr parser.Expr) []string {
+	var names []string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok && !slices.Contains(names, vs.Name) {
+			names = append(names, vs.Name)
+		}
+		return nil
+	})
+	return names
+}
+
+// derivedValue is the value of a derived expression: a vector if isVector is set, or a scalar.
+type derivedValue struct {
+	isVector bool
+	vector   []*model.Sample
+	scalar   float64
+}
+
+// evalDerived evaluates expr, as checked by parseDerivedExpr, over the samples of the metrics
+// it refers to.
+func evalDerived(expr parser.Expr, inputs map[string][]*model.Sample) (derivedValue, error) {
+	switch e := expr.(type) {
+	case *parser.NumberLiteral:
+		return derivedValue{scalar: e.Val}, nil
+	case *parser.ParenExpr:
+		return evalDerived(e.Expr, inputs)
+	case *parser.VectorSelector:
+		return derivedValue{isVector: true, vector: inputs[e.Name]}, nil
+	case *parser.UnaryExpr:
+		v, err := evalDerived(e.Expr, inputs)
+		if err != nil || e.Op != parser.SUB {
+			return v, err
+		}
+		return applyScalar(v, func(x float64) float64 { return -x }), nil
+	case *parser.BinaryExpr:
+		lhs, err := evalDerived(e.LHS, inputs)
+		if err != nil {
+			return derivedValue{}, err
+		}
+		rhs, err := evalDerived(e.RHS, inputs)
+		if err != nil {
+			return derivedValue{}, err
+		}
+		switch {
+		case !lhs.isVector && !rhs.isVector:
+			return derivedValue{scalar: arithmetic(e.Op, lhs.scalar, rhs.scalar)}, nil
+		case !rhs.isVector:
+			return applyScalar(lhs, func(x float64) float64 { return arithmetic(e.Op, x, rhs.scalar) }), nil
+		case !lhs.isVector:
+			return applyScalar(rhs, func(x float64) float64 { return arithmetic(e.Op, lhs.scalar, x) }), nil
+		}
+		vector, err := vectorArithmetic(e.Op, e.VectorMatching, lhs.vector, rhs.vector)
+		return derivedValue{isVector: true, vector: vector}, err
+	default:
+		return derivedValue{}, fmt.Errorf("unsupported expression %s", expr)
+	}
+}
+
+// applyScalar applies f to the value of v, or to every sample of it.
+func applyScalar(v derivedValue, f func(float64) float64) derivedValue {
+	if !v.isVector {
+		return derivedValue{scalar: f(v.scalar)}
+	}
+	vector := make([]*model.Sample, 0, len(v.vector))
+	for _, sample := range v.vector {
+		vector = append(vector, &model.Sample{Metric: sample.Metric, Value: model.SampleValue(f(float64(sample.Value))), Timestamp: sample.Timestamp})
+	}
+	return derivedValue{isVector: true, vector: vector}
+}
+
+func arithmetic(op parser.ItemType, l, r float64) float64 {
+	switch op {
+	case parser.ADD:
+		return l + r
+	case parser.SUB:
+		return l - r
+	case parser.MUL:
+		return l * r
+	case parser.DIV:
+		return l / r
+	case parser.MOD:
+		return math.Mod(l, r)
+	case parser.POW:
+		return math.Pow(l, r)
+	default:
+		return math.NaN()
+	}
+}
+
+// vectorArithmetic applies op to the series of lhs and rhs matched on labels as in PromQL.
+// Series without a match are left out.
+func vectorArithmetic(op parser.ItemType, matching *parser.VectorMatching, lhs, rhs []*model.Sample) ([]*model.Sample, error) {
+	if matching == nil {
+		matching = &parser.VectorMatching{Card: parser.CardOneToOne}
+	}
+	signature := func(metric model.Metric) string {
+		ls := model.LabelSet{}
+		for name, value := range metric {
+			if name != model.MetricNameLabel && slices.Contains(matching.MatchingLabels, string(name)) == matching.On {
+				ls[name] = value
+			}
+		}
+		return ls.String()
+	}
+
+	// the "one" side must have a single series per signature, and so must the other for
+	// one-to-one matching
+	many, one := lhs, rhs
+	if matching.Card == parser.CardOneToMany {
+		many, one = rhs, lhs
+	}
+	oneBySig := make(map[string]*model.Sample, len(one))
+	for _, sample := range one {
+		sig := signature(sample.Metric)
+		if _, ok := oneBySig[sig]; ok {
+			return nil, fmt.Errorf("several series match on %s, use on or ignoring to make them unique", sig)
+		}
+		oneBySig[sig] = sample
+	}
+
+	matched := make(map[string]struct{}, len(many))
+	seen := make(map[model.Fingerprint]struct{}, len(many))
+	result := make([]*model.Sample, 0, len(many))
+	for _, sample := range many {
+		sig := signature(sample.Metric)
+		match, ok := oneBySig[sig]
+		if !ok {
+			continue
+		}
+		if matching.Card == parser.CardOneToOne {
+			if _, ok := matched[sig]; ok {
+				return nil, fmt.Errorf("several series match on %s, use group_left or group_right for many-to-one matching", sig)
+			}
+			matched[sig] = struct{}{}
+		}
+
+		metric := resultMetric(sample.Metric, match.Metric, matching)
+		if _, ok := seen[metric.Fingerprint()]; ok {
+			return nil, fmt.Errorf("several results have the labels %s, the matching must make them unique", metric)
+		}
+		seen[metric.Fingerprint()] = struct{}{}
+
+		l, r := sample.Value, match.Value
+		if matching.Card == parser.CardOneToMany {
+			l, r = r, l
+		}
+		result = append(result, &model.Sample{
+			Metric:    metric,
+			Value:     model.SampleValue(arithmetic(op, float64(l), float64(r))),
+			Timestamp: max(sample.Timestamp, match.Timestamp),
+		})
+	}
+	return result, nil
+}
+
+// resultMetric returns the labels of the result of matching the many side series to the one
+// side series, as PromQL does.
+func resultMetric(many, one model.Metric, matching *parser.VectorMatching) model.Metric {
+	metric := model.Metric{}
+	for name, value := range many {
+		if name == model.MetricNameLabel {
+			continue
+		}
+		if matching.Card == parser.CardOneToOne && slices.Contains(matching.MatchingLabels, string(name)) != matching.On {
+			continue
+		}
+		metric[name] = value
+	}
+	for _, name := range matching.Include {
+		if value, ok := one[model.LabelName(name)]; ok {
+			metric[model.LabelName(name)] = value
+		} else {
+			delete(metric, model.LabelName(name))
+		}
+	}
+	return metric
+}
+
+// evaluateDerived recomputes the derived metrics referring to a metric of group, a subset of
+// conf, from the latest fresh samples of their inputs. The samples computed are held to the
+// global max_series, counting every other metric first, then added to data and the metrics
+// they belong to returned. Callers must hold the write lock.
+func (s *PromToScrapeServer) evaluateDerived(conf, group *Config, data Data, now time.Time) []Metric {
+	refreshed := make(map[string]struct{}, len(group.Metrics))
+	for _, metric := range group.Metrics {
+		refreshed[metric.key()] = struct{}{}
+	}
+
+	var evaluated []Metric
+	for _, d := range conf.DerivedMetrics {
+		names := derivedInputs(d.expr)
+		keys := make(map[string]string, len(names))
+		for _, name := range names {
+			keys[name] = Metric{MetricName: name, Account: d.Account}.key()
+		}
+		if !slices.ContainsFunc(names, func(name string) bool {
+			_, ok := refreshed[keys[name]]
+			return ok
+		}) {
+			continue
+		}
+
+		metric := d.metric()
+		state, ok := s.metrics[metric.key()]
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		samples, err := s.evalDerivedMetric(conf, d, keys, now)
+		if err == nil && conf.MaxSeries > 0 {
+			held := s.heldSeries(conf, now, func(key string) bool { return key == metric.key() })
+			limited := metric
+			limited.SeriesLimitPolicy = conf.SeriesLimitPolicy
+			samples, err = applySeriesLimit(limited, samples, max(conf.MaxSeries-held, 0), seriesLimitGlobal)
+		}
+		state.lastAttempt = now
+		state.lastDuration = time.Since(start)
+		if err != nil {
+			state.lastError = err
+			slog.Warn("failed to evaluate derived metric", "metric", metric.key(), "error", err)
+			continue
+		}
+		state.samples = samples
+		state.lastSuccess = now
+		state.lastError = nil
+		data[metric.key()] = samples
+		evaluated = append(evaluated, metric)
+	}
+	return evaluated
+}
+
+// evalDerivedMetric evaluates d over the samples held for its inputs, whose keys are given
+// by name. Callers must hold the lock.
+func (s *PromToScrapeServer) evalDerivedMetric(conf *Config, d DerivedMetric, keys map[string]string, now time.Time) ([]*model.Sample, error) {
+	inputs := make(map[string][]*model.Sample, len(keys))
+	for name, key := range keys {
+		state, ok := s.metrics[key]
+		if !ok || state.lastSuccess.IsZero() || now.Sub(state.lastSuccess) >= conf.StalenessThreshold {
+			return nil, fmt.Errorf("metric %q has no fresh samples", name)
+		}
+		inputs[name] = state.samples
+	}
+	v, err := evalDerived(d.expr, inputs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate %s: %w", d.Expr, err)
+	}
+	return v.vector, nil
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestParseDerivedExpr(t *testing.T) {
+	known := func(name string) bool { return name == "failed" || name == "total" }
+	testCases := []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: "failed / total"},
+		{expr: "100 * (failed / on(temporal_namespace) group_left(region) -total) ^ 2"},
+		{expr: "missing / total", wantErr: "not a configured metric"},
+		{expr: "rate(failed[1m])", wantErr: "only arithmetic"},
+		{expr: "failed > total", wantErr: "operator > is not supported"},
+		{expr: "failed offset 1m", wantErr: "bare metric name"},
+		{expr: `failed{temporal_namespace="a"}`, wantErr: "bare metric name"},
+		{expr: "1 + 2", wantErr: "at least one metric"},
+		{expr: "failed /", wantErr: "parse error"},
+	}
+	for _, tc := range testCases {
+		_, err := parseDerivedExpr(tc.expr, known)
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("parseDerivedExpr(%q) = %v", tc.expr, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("parseDerivedExpr(%q) = %v, want error containing %q", tc.expr, err, tc.wantErr)
+		}
+	}
+}
+
+func series(value float64, labels ...string) *model.Sample {
+	metric := model.Metric{}
+	for i := 0; i < len(labels); i += 2 {
+		metric[model.LabelName(labels[i])] = model.LabelValue(labels[i+1])
+	}
+	return &model.Sample{Metric: metric, Value: model.SampleValue(value)}
+}
+
+func TestEvalDerived(t *testing.T) {
+	inputs := map[string][]*model.Sample{
+		"failed": {
+			series(1, "temporal_namespace", "a", "operation", "Poll"),
+			series(3, "temporal_namespace", "b", "operation", "Poll"),
+			series(5, "temporal_namespace", "c", "operation", "Poll"),
+		},
+		"total": {
+			series(4, "temporal_namespace", "a", "operation", "Poll"),
+			series(6, "temporal_namespace", "b", "operation", "Poll"),
+		},
+		"region": {
+			series(1, "temporal_namespace", "a", "region", "us-east-1"),
+			series(1, "temporal_namespace", "b", "region", "eu-west-1"),
+		},
+	}
+	testCases := []struct {
+		expr    string
+		want    []string
+		wantErr string
+	}{
+		{
+			expr: "100 * failed / total",
+			want: []string{`{operation="Poll", temporal_namespace="a"} 25`, `{operation="Poll", temporal_namespace="b"} 50`},
+		},
+		{
+			expr: "failed - on(temporal_namespace) total",
+			want: []string{`{temporal_namespace="a"} -3`, `{temporal_namespace="b"} -3`},
+		},
+		{
+			expr: "failed * on(temporal_namespace) group_left(region) region",
+			want: []string{`{operation="Poll", region="eu-west-1", temporal_namespace="b"} 3`, `{operation="Poll", region="us-east-1", temporal_namespace="a"} 1`},
+		},
+		{
+			expr: "-failed % 2",
+			want: []string{`{operation="Poll", temporal_namespace="a"} -1`, `{operation="Poll", temporal_namespace="b"} -1`, `{operation="Poll", temporal_namespace="c"} -1`},
+		},
+		{
+			expr:    "failed / ignoring(temporal_namespace) total",
+			wantErr: "several series match",
+		},
+	}
+	for _, tc := range testCases {
+		expr, err := parseDerivedExpr(tc.expr, func(string) bool { return true })
+		if err != nil {
+			t.Fatalf("parseDerivedExpr(%q) = %v", tc.expr, err)
+		}
+		v, err := evalDerived(expr, inputs)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("evalDerived(%q) = %v, want error containing %q", tc.expr, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("evalDerived(%q) = %v", tc.expr, err)
+		}
+		var got []string
+		for _, sample := range v.vector {
+			got = append(got, sample.Metric.String()+" "+sample.Value.String())
+		}
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("evalDerived(%q) =\n%s\nwant\n%s", tc.expr, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestEvaluateDerived(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+accounts:
+  - name: prod
+    prom_endpoint: https://prod.tmprl.cloud/prometheus
+    bearer_token_env: PROD_API_KEY
+    metrics:
+      - metric_name: failed
+        query: failed
+      - metric_name: total
+        query: total
+        interval: 2m
+    derived_metrics:
+      - metric_name: error_ratio
+        expr: failed / total
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.DerivedMetrics[0].metric(); got.key() != "prod/error_ratio" || got.Labels[AccountLabel] != "prod" {
+		t.Fatalf("derived metric of an account is %+v", got)
+	}
+
+	now := time.Now()
+	s := &PromToScrapeServer{metrics: map[string]*metricState{}}
+	s.conf.Store(conf)
+	group := *conf
+	group.Metrics = conf.Metrics[:1]
+
+	// total was never queried
+	data := Data{"prod/failed": []*model.Sample{series(1, "temporal_namespace", "a")}}
+	s.updateStates(conf, data, QueryErrors{}, QueryDurations{}, now)
+	if evaluated := s.evaluateDerived(conf, &group, data, now); len(evaluated) != 0 {
+		t.Errorf("evaluated %v without fresh samples of total", evaluated)
+	}
+	if err := s.metrics["prod/error_ratio"].lastError; err == nil || !strings.Contains(err.Error(), `"total" has no fresh samples`) {
+		t.Errorf("got error %v, want total to be missing", err)
+	}
+
+	s.metrics["prod/total"].samples = []*model.Sample{series(4, "temporal_namespace", "a")}
+	s.metrics["prod/total"].lastSuccess = now
+	evaluated := s.evaluateDerived(conf, &group, data, now)
+	if len(evaluated) != 1 || evaluated[0].MetricName != "error_ratio" {
+		t.Fatalf("evaluated %v, want error_ratio", evaluated)
+	}
+	if got := data["prod/error_ratio"]; len(got) != 1 || got[0].Value != 0.25 {
+		t.Errorf("got %v for error_ratio, want 0.25", got)
+	}
+	if state := s.metrics["prod/error_ratio"]; state.lastError != nil || state.lastSuccess != now {
+		t.Errorf("error_ratio state is %+v after evaluation", state)
+	}
+}
+
+func TestEvaluateDerivedSeriesLimit(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+max_series: 5
+metrics:
+  - metric_name: failed
+    query: failed
+  - metric_name: total
+    query: total
+derived_metrics:
+  - metric_name: error_ratio
+    expr: failed / total
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &PromToScrapeServer{metrics: map[string]*metricState{}}
+	s.conf.Store(conf)
+
+	data := Data{"failed": namespaceSamples("a", "b"), "total": namespaceSamples("a", "b")}
+	s.updateStates(conf, data, QueryErrors{}, QueryDurations{}, now)
+	s.evaluateDerived(conf, conf, data, now)
+	if got := len(data["error_ratio"]); got != 1 {
+		t.Fatalf("kept %d series of error_ratio, want the 1 left under the limit", got)
+	}
+	s.updateStates(conf, Data{"error_ratio": data["error_ratio"]}, QueryErrors{}, QueryDurations{}, now)
+
+	// the derived series count against the limit of the next refresh
+	data = Data{"total": namespaceSamples("a", "b", "c")}
+	errs := QueryErrors{}
+	s.limitGlobalSeries(conf, conf, data, errs, now)
+	if got := len(data["total"]); got != 2 {
+		t.Errorf("kept %d series of total, want the 2 left next to failed and error_ratio", got)
+	}
+
+	conf.SeriesLimitPolicy = SeriesLimitReject
+	data = Data{"failed": namespaceSamples("a", "b"), "total": namespaceSamples("a", "b")}
+	if evaluated := s.evaluateDerived(conf, conf, data, now); len(evaluated) != 0 {
+		t.Errorf("evaluated %v over the limit with the reject policy", evaluated)
+	}
+	if err := s.metrics["error_ratio"].lastError; err == nil || !strings.Contains(err.Error(), "global max_series") {
+		t.Errorf("got error %v, want the global limit to reject error_ratio", err)
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/exp/slog"
+)
+
+// contentEncodings are the compressions offered on /metrics, preferred first when the
+// scraper accepts several with the same q-value. They are the ones promhttp can offer.
+var contentEncodings = []string{"zstd", "gzip"}
+
+// expositionHandler serves gathered metrics in the format negotiated with the scraper: text,
+// OpenMetrics or protobuf, compressed with zstd or gzip if accepted. It is used instead of
+// promhttp for the queried series because promhttp never writes the OpenMetrics UNIT
+// metadata.
+type expositionHandler struct {
+	gatherer prometheus.Gatherer
+}
+
+func (h expositionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mfs, err := h.gatherer.Gather()
+	if err != nil {
+		if len(mfs) == 0 {
+			slog.Error("error gathering metrics", "error", err)
+			http.Error(w, "An error has occurred while gathering metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// like promhttp.ContinueOnError, serve whatever could be gathered
+		slog.Warn("error gathering metrics", "error", err)
+	}
+
+	// encoded in full first, so an encoding error is still reported with a status code
+	// rather than as a truncated body
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	var buf bytes.Buffer
+	enc := expfmt.NewEncoder(&buf, format, expfmt.WithUnit())
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			slog.Error("failed to encode metric family", "metric", mf.GetName(), "error", err)
+			http.Error(w, "An error has occurred while encoding metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("failed to finish encoding metrics", "error", err)
+			http.Error(w, "An error has occurred while encoding metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", string(format))
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r, contentEncodings)
+	var out io.WriteCloser
+	switch encoding {
+	case "zstd":
+		if out, err = zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest)); err != nil {
+			slog.Warn("failed to compress metrics, serving them uncompressed", "encoding", encoding, "error", err)
+			encoding = ""
+		}
+	case "gzip":
+		out = gzip.NewWriter(w)
+	}
+	if encoding == "" {
+		w.Write(buf.Bytes())
+		return
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		slog.Warn("failed to write metrics", "error", err)
+	}
+	if err := out.Close(); err != nil {
+		slog.Warn("failed to write metrics", "error", err)
+	}
+}
+
+// negotiateEncoding returns the coding of offers that the Accept-Encoding header of r gives
+// the highest q-value, the earlier offer on a tie, or "" to send the body uncompressed.
+// "*" matches every offer not listed by name, and a q-value of 0 refuses the coding.
+func negotiateEncoding(r *http.Request, offers []string) string {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+				q = 0
+			}
+		}
+		accepted[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, ok := accepted[offer]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
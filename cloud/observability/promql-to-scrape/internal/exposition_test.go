@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: ""},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "deflate, gzip;q=0.5", want: "gzip"},
+		{acceptEncoding: "gzip;q=0", want: ""},
+		{acceptEncoding: "gzip; q=0.0, identity", want: ""},
+		{acceptEncoding: "gzip;q=bogus", want: ""},
+		{acceptEncoding: "x-gzip, br", want: ""},
+		{acceptEncoding: "gzip, zstd", want: "zstd"},
+		{acceptEncoding: "zstd;q=0.5, gzip", want: "gzip"},
+		{acceptEncoding: "*", want: "zstd"},
+		{acceptEncoding: "*, zstd;q=0", want: "gzip"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		if got := negotiateEncoding(r, contentEncodings); got != tc.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestExpositionEncodings(t *testing.T) {
+	gatherer := prometheus.NewRegistry()
+	gatherer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "up_gauge", Help: "Up."}, func() float64 { return 1 }))
+	handler := expositionHandler{gatherer}
+
+	testCases := []struct {
+		acceptEncoding string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{acceptEncoding: "", decode: func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{acceptEncoding: "gzip", decode: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{acceptEncoding: "zstd", decode: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	}
+	for _, tc := range testCases {
+		t.Run("encoding "+tc.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if got := rec.Header().Get("Content-Encoding"); got != tc.acceptEncoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tc.acceptEncoding)
+			}
+			dec, err := tc.decode(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(dec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), "up_gauge 1\n") {
+				t.Errorf("series is missing:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestExpositionErrors(t *testing.T) {
+	gatherErr := errors.New("collect failed")
+	testCases := []struct {
+		name     string
+		gatherer prometheus.GathererFunc
+		want     int
+	}{
+		{
+			name:     "nothing gathered",
+			gatherer: func() ([]*dto.MetricFamily, error) { return nil, gatherErr },
+			want:     http.StatusInternalServerError,
+		},
+		{
+			name: "partly gathered",
+			gatherer: func() ([]*dto.MetricFamily, error) {
+				return []*dto.MetricFamily{{
+					Name:   proto.String("up_gauge"),
+					Type:   dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+				}}, gatherErr
+			},
+			want: http.StatusOK,
+		},
+		{
+			name: "family that can't be encoded",
+			gatherer: func() ([]*dto.MetricFamily, error) {
+				return []*dto.MetricFamily{{Name: proto.String("empty"), Type: dto.MetricType_GAUGE.Enum()}}, nil
+			},
+			want: http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			expositionHandler{tc.gatherer}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if rec.Code != tc.want {
+				t.Errorf("got status %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpositionUnit(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+metrics:
+  - metric_name: poll_latency_seconds
+    query: poll_latency
+    unit: seconds
+    help: Poll latency.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &PromToScrapeServer{metrics: map[string]*metricState{
+		"poll_latency_seconds": {metric: conf.Metrics[0], samples: namespaceSamples("a"), lastSuccess: time.Now()},
+	}}
+	s.conf.Store(conf)
+	s.registry = prometheus.NewRegistry()
+	s.registry.MustRegister(sampleCollector{s})
+	handler := expositionHandler{prometheus.GathererFunc(s.gather)}
+
+	testCases := []struct {
+		name     string
+		accept   string
+		wantUnit bool
+	}{
+		{name: "openmetrics", accept: "application/openmetrics-text;version=1.0.0", wantUnit: true},
+		{name: "text", accept: "text/plain;version=0.0.4", wantUnit: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.Header.Set("Accept", tc.accept)
+			r.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("got Vary %q, want Accept-Encoding", got)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("got Content-Encoding %q, want gzip", got)
+			}
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := strings.Contains(string(body), "# UNIT poll_latency_seconds seconds\n"); got != tc.wantUnit {
+				t.Errorf("UNIT in output = %t, want %t:\n%s", got, tc.wantUnit, body)
+			}
+			if !strings.Contains(string(body), "# HELP poll_latency_seconds Poll latency.\n") {
+				t.Errorf("configured HELP is missing:\n%s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// readiness is the body of the "/readyz" response. LastSuccessfulRefresh and DataAgeSeconds
+// are those of the group of metrics refreshed least recently, and UpstreamReachable is set
+// only if the last refresh of every group got a query through.
+type readiness struct {
+	Ready                     bool       `json:"ready"`
+	Reasons                   []string   `json:"reasons,omitempty"`
+	LastSuccessfulRefresh     *time.Time `json:"last_successful_refresh,omitempty"`
+	DataAgeSeconds            *float64   `json:"data_age_seconds,omitempty"`
+	StalenessThresholdSeconds float64    `json:"staleness_threshold_seconds"`
+	UpstreamReachable         bool       `json:"upstream_reachable"`
+	ConfiguredMetrics         int        `json:"configured_metrics"`
+}
+
+// healthzHandler is the HTTP handler for the "/healthz" endpoint. It only reports that the
+// process is up and serving HTTP.
+func (s *PromToScrapeServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler is the HTTP handler for the "/readyz" endpoint. The server is ready once every
+// group of metrics sharing an account and interval has had a refresh succeed, that data is
+// younger than the staleness threshold and the last refresh of the group reached upstream.
+func (s *PromToScrapeServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := s.readiness(time.Now())
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+func (s *PromToScrapeServer) readiness(now time.Time) readiness {
+	conf := s.conf.Load()
+
+	s.RLock()
+	defer s.RUnlock()
+
+	status := readiness{
+		StalenessThresholdSeconds: conf.StalenessThreshold.Seconds(),
+		UpstreamReachable:         true,
+		ConfiguredMetrics:         len(conf.Metrics),
+	}
+
+	var oldest time.Time
+	for _, key := range slices.SortedFunc(maps.Keys(conf.groupBySchedule()), compareGroupKeys) {
+		group, ok := s.groups[key]
+		if !ok || !group.upstreamReachable {
+			status.UpstreamReachable = false
+		}
+		if !ok || group.lastSuccessfulRefresh.IsZero() {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("no refresh of %s has succeeded yet", key))
+			continue
+		}
+		if oldest.IsZero() || group.lastSuccessfulRefresh.Before(oldest) {
+			oldest = group.lastSuccessfulRefresh
+		}
+		if now.Sub(group.lastSuccessfulRefresh) >= conf.StalenessThreshold {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("data of %s is older than %s", key, conf.StalenessThreshold))
+		}
+		if !group.upstreamReachable {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("every query of the last refresh of %s failed", key))
+		}
+	}
+	if !oldest.IsZero() {
+		age := now.Sub(oldest).Seconds()
+		status.LastSuccessfulRefresh = &oldest
+		status.DataAgeSeconds = &age
+	}
+
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to write response", "error", err)
+	}
+}
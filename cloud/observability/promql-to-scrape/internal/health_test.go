@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	(&PromToScrapeServer{}).healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode /healthz: %v", err)
+	}
+	if rec.Code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("got %d %v, want 200 with status ok", rec.Code, body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+staleness_threshold: 5m
+metrics:
+  - metric_name: a
+    query: a
+    interval: 30s
+  - metric_name: b
+    query: b
+    interval: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, slow := groupKey{interval: 30 * time.Second}, groupKey{interval: time.Minute}
+	now := time.Now()
+
+	testCases := []struct {
+		name          string
+		groups        map[groupKey]*groupState
+		wantCode      int
+		wantReasons   []string
+		wantReachable bool
+		wantAge       time.Duration
+	}{
+		{
+			name:        "never refreshed",
+			wantCode:    http.StatusServiceUnavailable,
+			wantReasons: []string{"no refresh of metrics every 30s has succeeded yet", "no refresh of metrics every 1m has succeeded yet"},
+			wantAge:     -1,
+		},
+		{
+			name: "one group refreshed",
+			groups: map[groupKey]*groupState{
+				fast: {lastSuccessfulRefresh: now.Add(-10 * time.Second), upstreamReachable: true},
+			},
+			wantCode:    http.StatusServiceUnavailable,
+			wantReasons: []string{"no refresh of metrics every 1m has succeeded yet"},
+			wantAge:     10 * time.Second,
+		},
+		{
+			name: "fresh",
+			groups: map[groupKey]*groupState{
+				fast: {lastSuccessfulRefresh: now.Add(-10 * time.Second), upstreamReachable: true},
+				slow: {lastSuccessfulRefresh: now.Add(-40 * time.Second), upstreamReachable: true},
+			},
+			wantCode:      http.StatusOK,
+			wantReachable: true,
+			wantAge:       40 * time.Second,
+		},
+		{
+			name: "one group stale",
+			groups: map[groupKey]*groupState{
+				fast: {lastSuccessfulRefresh: now.Add(-10 * time.Second), upstreamReachable: true},
+				slow: {lastSuccessfulRefresh: now.Add(-10 * time.Minute), upstreamReachable: true},
+			},
+			wantCode:      http.StatusServiceUnavailable,
+			wantReasons:   []string{"data of metrics every 1m is older than 5m0s"},
+			wantReachable: true,
+			wantAge:       10 * time.Minute,
+		},
+		{
+			name: "one group unreachable",
+			groups: map[groupKey]*groupState{
+				fast: {lastSuccessfulRefresh: now.Add(-40 * time.Second), upstreamReachable: false},
+				slow: {lastSuccessfulRefresh: now.Add(-10 * time.Second), upstreamReachable: true},
+			},
+			wantCode:    http.StatusServiceUnavailable,
+			wantReasons: []string{"every query of the last refresh of metrics every 30s failed"},
+			wantAge:     40 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &PromToScrapeServer{groups: tc.groups}
+			s.conf.Store(conf)
+
+			rec := httptest.NewRecorder()
+			s.readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			var got readiness
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode /readyz: %v", err)
+			}
+
+			if rec.Code != tc.wantCode || got.Ready != (tc.wantCode == http.StatusOK) {
+				t.Errorf("got %d with ready %t, want %d", rec.Code, got.Ready, tc.wantCode)
+			}
+			if !slices.Equal(got.Reasons, tc.wantReasons) {
+				t.Errorf("got reasons %q, want %q", got.Reasons, tc.wantReasons)
+			}
+			if got.StalenessThresholdSeconds != 300 || got.ConfiguredMetrics != 2 || got.UpstreamReachable != tc.wantReachable {
+				t.Errorf("got %+v", got)
+			}
+			switch {
+			case tc.wantAge < 0 && got.DataAgeSeconds != nil:
+				t.Errorf("got data age %v before any successful refresh", *got.DataAgeSeconds)
+			case tc.wantAge >= 0 && (got.DataAgeSeconds == nil || *got.DataAgeSeconds < tc.wantAge.Seconds() || *got.DataAgeSeconds > tc.wantAge.Seconds()+5):
+				t.Errorf("got data age %v, want about %v", got.DataAgeSeconds, tc.wantAge.Seconds())
+			}
+		})
+	}
+}
+
+func TestReadinessAfterRefresh(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := "metrics:\n  - metric_name: ok\n    query: ok\n    interval: 30s\n  - metric_name: failing\n    query: fail\n    interval: 1m\n"
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client := &scriptedQuerier{}
+	s, err := NewPromToScrapeServer(client, configFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPromToScrapeServer() = %v", err)
+	}
+
+	conf := s.conf.Load()
+	for key, metrics := range conf.groupBySchedule() {
+		group := *conf
+		group.Metrics = metrics
+		s.queryMetrics(context.Background(), conf, key, &group, client)
+	}
+
+	status := s.readiness(time.Now())
+	want := []string{"no refresh of metrics every 1m has succeeded yet"}
+	if status.Ready || status.UpstreamReachable || !slices.Equal(status.Reasons, want) {
+		t.Errorf("got %+v, want only the failing group reported", status)
+	}
+}
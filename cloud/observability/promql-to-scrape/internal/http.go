@@ -3,17 +3,26 @@ package internal
 import (
 	"bytes"
 	"context"
+	"errors"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
 )
 
 type HttpClient struct {
 	Endpoint *url.URL
 	Client   *http.Client
+
+	upstream *upstream
 }
 
+// NewHttpClient returns a client for the API at addr, paced by the default UpstreamConfig
+// until SetUpstreamConfig is called.
 func NewHttpClient(addr string, httpClient *http.Client) (*HttpClient, error) {
 	u, err := url.Parse(addr)
 	if err != nil {
@@ -21,12 +30,20 @@ func NewHttpClient(addr string, httpClient *http.Client) (*HttpClient, error) {
 	}
 	u.Path = strings.TrimRight(u.Path, "/")
 
+	var conf UpstreamConfig
+	conf.applyDefaults()
 	return &HttpClient{
 		Endpoint: u,
 		Client:   httpClient,
+		upstream: newUpstream(u.Host, conf),
 	}, nil
 }
 
+// SetUpstreamConfig changes the rate limit, retries and circuit breaker of the client.
+func (c *HttpClient) SetUpstreamConfig(conf UpstreamConfig) {
+	c.upstream.setConfig(conf)
+}
+
 func (c *HttpClient) URL(ep string, args map[string]string) *url.URL {
 	p := path.Join(c.Endpoint.Path, ep)
 
@@ -41,7 +58,71 @@ func (c *HttpClient) URL(ep string, args map[string]string) *url.URL {
 	return &u
 }
 
+// Do sends req at the pace allowed by the rate limit, retrying the failures retryable
+// reports with backoff. A Retry-After header is waited out, unless the request would time
+// out first. Nothing is sent while the circuit breaker is open.
 func (c *HttpClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	if err := c.upstream.allow(time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		resp *http.Response
+		body []byte
+		err  error
+	)
+	for attempt := 0; ; attempt++ {
+		if err := c.upstream.wait(ctx); err != nil {
+			c.upstream.cancel()
+			return nil, nil, err
+		}
+		resp, body, err = c.do(ctx, req)
+		if !retryable(resp, err) || ctx.Err() != nil || attempt >= c.upstream.maxRetries() {
+			break
+		}
+		if req.Body != nil && req.GetBody == nil {
+			break
+		}
+		delay := max(c.upstream.backoff(attempt), retryAfter(resp, time.Now()))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			break
+		}
+
+		upstreamRetries.WithLabelValues(c.Endpoint.Host).Inc()
+		slog.Debug("retrying upstream request", "endpoint", c.Endpoint.Host, "backoff", delay, "status", statusOf(resp), "error", err)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			c.upstream.done(time.Now(), !errors.Is(ctx.Err(), context.Canceled))
+			return nil, nil, ctx.Err()
+		}
+		if req.GetBody != nil {
+			b, err := req.GetBody()
+			if err != nil {
+				c.upstream.cancel()
+				return nil, nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = b
+		}
+	}
+
+	c.upstream.done(time.Now(), retryable(resp, err) && !errors.Is(err, context.Canceled))
+	return resp, body, err
+}
+
+// statusOf returns the status of resp for logging, empty if there was no response.
+func statusOf(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	return resp.Status
+}
+
+// do makes a single attempt at req.
+func (c *HttpClient) do(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
 	if ctx != nil {
 		req = req.WithContext(ctx)
 	}
@@ -56,8 +137,10 @@ func (c *HttpClient) Do(ctx context.Context, req *http.Request) (*http.Response,
 	}()
 
 	if err != nil {
+		upstreamResponses.WithLabelValues("error").Inc()
 		return nil, nil, err
 	}
+	upstreamResponses.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
 
 	var body []byte
 	done := make(chan struct{})
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics about the exporter itself. They live in their own registry so they never mix
+// with the series queried from upstream and served on /metrics.
+var (
+	internalRegistry = prometheus.NewRegistry()
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of upstream queries by configured metric name and account.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"metric_name", "account"})
+
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "query_errors_total",
+		Help:      "Failed upstream queries by configured metric name and account.",
+	}, []string{"metric_name", "account"})
+
+	lastRefresh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "last_successful_refresh_timestamp_seconds",
+		Help:      "Unix time of the last refresh in which at least one query succeeded.",
+	})
+
+	seriesEmitted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "series_emitted",
+		Help:      "Number of queried series served on the last request to /metrics.",
+	})
+
+	seriesLimitExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "series_limit_exceeded_total",
+		Help:      "Refreshes of a metric that went over max_series, by limit: metric or global.",
+	}, []string{"metric_name", "account", "limit"})
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "config_reloads_total",
+		Help:      "Config reloads by result.",
+	}, []string{"result"})
+
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last config reload succeeded.",
+	})
+
+	upstreamResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "upstream_responses_total",
+		Help:      "Responses from the Prometheus API by HTTP status code, or \"error\" if no response was received.",
+	}, []string{"code"})
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "upstream_retries_total",
+		Help:      "Retried requests to the Prometheus API by endpoint host.",
+	}, []string{"endpoint"})
+
+	circuitBreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "upstream_circuit_breaker_open",
+		Help:      "Whether queries to the Prometheus API at the endpoint host are paused after repeated failures.",
+	}, []string{"endpoint"})
+
+	pushSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "push_samples_total",
+		Help:      "Samples pushed by target (remote_write or otlp) and result: sent, failed or dropped from a full queue.",
+	}, []string{"target", "result"})
+
+	pushRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "push_retries_total",
+		Help:      "Retried pushes by target.",
+	}, []string{"target"})
+
+	pushQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "push_queue_length",
+		Help:      "Refreshes waiting to be pushed by target.",
+	}, []string{"target"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "query_cache_requests_total",
+		Help:      "Query cache lookups by result: hit, miss or error.",
+	}, []string{"result"})
+
+	clientCertExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "promql_to_scrape",
+		Name:      "client_cert_expiry_timestamp_seconds",
+		Help:      "Unix time at which the client certificate loaded from cert_file expires.",
+	}, []string{"cert_file"})
+)
+
+func init() {
+	configLastReloadSuccessful.Set(1)
+	internalRegistry.MustRegister(
+		queryDuration,
+		queryErrors,
+		lastRefresh,
+		seriesEmitted,
+		seriesLimitExceeded,
+		configReloads,
+		configLastReloadSuccessful,
+		upstreamResponses,
+		upstreamRetries,
+		circuitBreakerOpen,
+		pushSamples,
+		pushRetries,
+		pushQueueLength,
+		clientCertExpiry,
+		cacheRequests,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// internalMetricsHandler serves the exporter's own metrics, along with those of states, which
+// belong to a single server.
+func internalMetricsHandler(states prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(prometheus.Gatherers{internalRegistry, states}, promhttp.HandlerOpts{})
+}
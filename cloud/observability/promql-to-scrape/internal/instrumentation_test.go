@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api/prometheus/v1"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+func TestInternalMetricsAfterRefresh(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("query") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"temporal_namespace":"a"},"value":[1,"1"]}]}}`))
+	}))
+	defer upstream.Close()
+
+	httpClient, err := NewHttpClient(upstream.URL, upstream.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &APIClient{API: promapi.NewAPI(httpClient), http: httpClient}
+
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := "metrics:\n  - metric_name: instrumented_ok\n    query: ok\n  - metric_name: instrumented_bad\n    query: bad\n"
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewPromToScrapeServer(client, configFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPromToScrapeServer() = %v", err)
+	}
+	conf := s.conf.Load()
+
+	before := scrapeInternalMetrics(t, s)
+	start := time.Now()
+	s.queryMetrics(context.Background(), conf, groupKey{}, conf, client)
+	after := scrapeInternalMetrics(t, s)
+
+	counters := []struct {
+		family string
+		label  string
+		value  string
+		want   float64
+	}{
+		{family: "promql_to_scrape_upstream_responses_total", label: "code", value: "200", want: 1},
+		{family: "promql_to_scrape_upstream_responses_total", label: "code", value: "400", want: 1},
+		{family: "promql_to_scrape_query_errors_total", label: "metric_name", value: "instrumented_bad", want: 1},
+		{family: "promql_to_scrape_query_errors_total", label: "metric_name", value: "instrumented_ok", want: 0},
+	}
+	for _, c := range counters {
+		got := sampleValue(after[c.family], c.label, c.value) - sampleValue(before[c.family], c.label, c.value)
+		if got != c.want {
+			t.Errorf("%s{%s=%q} went up by %v, want %v", c.family, c.label, c.value, got, c.want)
+		}
+	}
+
+	for _, name := range []string{"instrumented_ok", "instrumented_bad"} {
+		got := observationCount(after["promql_to_scrape_query_duration_seconds"], name) - observationCount(before["promql_to_scrape_query_duration_seconds"], name)
+		if got != 1 {
+			t.Errorf("got %d query durations observed for %s, want 1", got, name)
+		}
+	}
+
+	states := []struct {
+		family string
+		metric string
+		want   float64
+	}{
+		{family: "promql_to_scrape_query_success", metric: "instrumented_ok", want: 1},
+		{family: "promql_to_scrape_query_success", metric: "instrumented_bad", want: 0},
+	}
+	for _, st := range states {
+		if got := sampleValue(after[st.family], "metric_name", st.metric); got != st.want {
+			t.Errorf("got %s{metric_name=%q} %v, want %v", st.family, st.metric, got, st.want)
+		}
+	}
+	if _, ok := after["promql_to_scrape_sample_age_seconds"]; !ok {
+		t.Error("sample age is missing")
+	}
+
+	refreshed := sampleValue(after["promql_to_scrape_last_successful_refresh_timestamp_seconds"], "", "")
+	if refreshed < float64(start.Unix()) || refreshed > float64(time.Now().Unix()) {
+		t.Errorf("got last successful refresh at %v, want between %d and now", refreshed, start.Unix())
+	}
+}
+
+// scrapeInternalMetrics returns the families served by s on /internal/metrics by name.
+func scrapeInternalMetrics(t *testing.T, s *PromToScrapeServer) map[string]*dto.MetricFamily {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/internal/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d from /internal/metrics", rec.Code)
+	}
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to parse /internal/metrics: %v", err)
+	}
+	return families
+}
+
+// sampleValue returns the value of the counter or gauge of mf whose label is value, or of its
+// only series if label is empty. Missing series are 0, as counters not yet incremented.
+func sampleValue(mf *dto.MetricFamily, label, value string) float64 {
+	for _, m := range mf.GetMetric() {
+		if label == "" || hasLabel(m, label, value) {
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+// observationCount returns the number of observations in the histogram of mf for metricName.
+func observationCount(mf *dto.MetricFamily, metricName string) uint64 {
+	for _, m := range mf.GetMetric() {
+		if hasLabel(m, "metric_name", metricName) {
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name && l.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}
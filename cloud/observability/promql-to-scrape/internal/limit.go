@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
+)
+
+// Series limits, as reported in the limit label of promql_to_scrape_series_limit_exceeded_total.
+const (
+	seriesLimitMetric = "metric"
+	seriesLimitGlobal = "global"
+)
+
+// applySeriesLimit keeps at most max of the samples of metric, or rejects them all, as the
+// policy of metric says. Truncation keeps the first series in label order, so the same ones
+// are kept on every refresh.
+func applySeriesLimit(metric Metric, samples []*model.Sample, max int, limit string) ([]*model.Sample, error) {
+	if len(samples) <= max {
+		return samples, nil
+	}
+	seriesLimitExceeded.WithLabelValues(metric.MetricName, metric.Account, limit).Inc()
+	if metric.SeriesLimitPolicy == SeriesLimitReject {
+		slog.Warn("rejecting metric over the series limit", "metric", metric.key(), "limit", limit, "series", len(samples), "allowed", max)
+		return nil, fmt.Errorf("%d series exceed the %d allowed by the %s max_series", len(samples), max, limit)
+	}
+
+	slog.Warn("truncating metric to the series limit", "metric", metric.key(), "limit", limit, "series", len(samples), "allowed", max)
+	sorted := slices.Clone(samples)
+	slices.SortFunc(sorted, func(a, b *model.Sample) int {
+		return strings.Compare(a.Metric.String(), b.Metric.String())
+	})
+	return sorted[:max], nil
+}
+
+// heldSeries counts the fresh series served by the metrics of conf, derived ones included,
+// leaving out those for which skip returns true. Callers must hold the lock.
+func (s *PromToScrapeServer) heldSeries(conf *Config, now time.Time, skip func(key string) bool) int {
+	keys := make([]string, 0, len(conf.Metrics)+len(conf.DerivedMetrics))
+	for _, metric := range conf.Metrics {
+		keys = append(keys, metric.key())
+	}
+	for _, d := range conf.DerivedMetrics {
+		keys = append(keys, d.metric().key())
+	}
+
+	held := 0
+	for _, key := range keys {
+		if skip(key) {
+			continue
+		}
+		if state, ok := s.metrics[key]; ok && !state.lastSuccess.IsZero() && now.Sub(state.lastSuccess) < conf.StalenessThreshold {
+			held += len(state.samples)
+		}
+	}
+	return held
+}
+
+// limitGlobalSeries holds the refresh of group, a subset of conf, to the global max_series,
+// counting the fresh series the other metrics, derived ones included, already serve. Metrics
+// of group are let in in config order, so once the limit is reached the later ones are
+// truncated or rejected. Rejected metrics move from data to errs. Callers must hold the write
+// lock.
+func (s *PromToScrapeServer) limitGlobalSeries(conf, group *Config, data Data, errs QueryErrors, now time.Time) {
+	if conf.MaxSeries == 0 {
+		return
+	}
+
+	held := s.heldSeries(conf, now, func(key string) bool {
+		_, ok := data[key]
+		return ok
+	})
+
+	for _, metric := range group.Metrics {
+		samples, ok := data[metric.key()]
+		if !ok {
+			continue
+		}
+		samples, err := applySeriesLimit(metric, samples, max(conf.MaxSeries-held, 0), seriesLimitGlobal)
+		if err != nil {
+			delete(data, metric.key())
+			errs[metric.key()] = err
+			continue
+		}
+		data[metric.key()] = samples
+		held += len(samples)
+	}
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplySeriesLimit(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  string
+		max     int
+		want    []string
+		wantErr bool
+	}{
+		{name: "under the limit", policy: SeriesLimitReject, max: 3, want: []string{"c", "a", "b"}},
+		{name: "truncate", policy: SeriesLimitTruncate, max: 2, want: []string{"a", "b"}},
+		{name: "reject", policy: SeriesLimitReject, max: 2, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metric := Metric{MetricName: strings.ReplaceAll(tc.name, " ", "_"), SeriesLimitPolicy: tc.policy}
+			got, err := applySeriesLimit(metric, namespaceSamples("c", "a", "b"), tc.max, seriesLimitMetric)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("applySeriesLimit() kept %d series, want an error", len(got))
+				}
+			} else {
+				var namespaces []string
+				for _, sample := range got {
+					namespaces = append(namespaces, string(sample.Metric["temporal_namespace"]))
+				}
+				if strings.Join(namespaces, ",") != strings.Join(tc.want, ",") {
+					t.Errorf("applySeriesLimit() kept %v, want %v", namespaces, tc.want)
+				}
+			}
+
+			wantHits := 1.0
+			if len(tc.want) == 3 {
+				wantHits = 0
+			}
+			if hits := testutil.ToFloat64(seriesLimitExceeded.WithLabelValues(metric.MetricName, "", seriesLimitMetric)); hits != wantHits {
+				t.Errorf("counted %v limit hits, want %v", hits, wantHits)
+			}
+		})
+	}
+}
+
+func TestLimitGlobalSeries(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+max_series: 5
+metrics:
+  - metric_name: held
+    query: held
+  - metric_name: truncated
+    query: truncated
+  - metric_name: rejected
+    query: rejected
+    series_limit_policy: reject
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &PromToScrapeServer{metrics: map[string]*metricState{
+		"held": {metric: conf.Metrics[0], samples: namespaceSamples("a", "b", "c"), lastSuccess: now},
+	}}
+
+	group := *conf
+	group.Metrics = conf.Metrics[1:]
+	data := Data{
+		"truncated": namespaceSamples("a", "b", "c"),
+		"rejected":  namespaceSamples("a"),
+	}
+	errs := QueryErrors{}
+	s.limitGlobalSeries(conf, &group, data, errs, now)
+
+	if got := len(data["truncated"]); got != 2 {
+		t.Errorf("kept %d series of the truncated metric, want the 2 left under the limit", got)
+	}
+	if _, ok := data["rejected"]; ok || errs["rejected"] == nil {
+		t.Errorf("metric over the global limit with the reject policy was not rejected")
+	}
+
+	// stale samples no longer count against the limit
+	s.metrics["held"].lastSuccess = now.Add(-time.Hour)
+	data = Data{"truncated": namespaceSamples("a", "b", "c"), "rejected": namespaceSamples("a")}
+	errs = QueryErrors{}
+	s.limitGlobalSeries(conf, &group, data, errs, now)
+	if len(data["truncated"]) != 3 || len(data["rejected"]) != 1 || len(errs) != 0 {
+		t.Errorf("refresh under the limit was changed: %v, %v", data, errs)
+	}
+}
@@ -0,0 +1,379 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpScope is the service name and instrumentation scope reported with every push.
+const otlpScope = "promql-to-scrape"
+
+// otlpExporter pushes refreshes as OTLP metrics over gRPC or HTTP.
+type otlpExporter struct {
+	client *http.Client
+	*pushQueue
+	starts *seriesStarts
+
+	// conns holds the gRPC connection to the current endpoint, connKey, reused across pushes,
+	// along with those to earlier endpoints that queued batches still push through. Keys
+	// identify the endpoint and security a connection was dialed with.
+	mu      sync.Mutex
+	conns   map[string]*otlpConn
+	connKey string
+}
+
+// otlpConn is a gRPC connection and the number of batches not yet done with it.
+type otlpConn struct {
+	conn    *grpc.ClientConn
+	batches int
+}
+
+func newOTLPExporter(capacity int) *otlpExporter {
+	return &otlpExporter{
+		client:    &http.Client{},
+		pushQueue: newPushQueue(pushTargetOTLP, capacity),
+		starts:    &seriesStarts{series: map[string]map[model.Fingerprint]seriesStart{}},
+		conns:     map[string]*otlpConn{},
+	}
+}
+
+// seriesStarts tracks the start time of every cumulative series pushed, which OTLP requires
+// on Sum points. The upstream counters do not report when they started, so a series starts
+// at its first point pushed and restarts when its value drops, a counter reset.
+type seriesStarts struct {
+	mu sync.Mutex
+	// series holds the series of each metric by the fingerprint of their labels.
+	series map[string]map[model.Fingerprint]seriesStart
+}
+
+type seriesStart struct {
+	start model.Time
+	last  model.Time
+	value model.SampleValue
+}
+
+// observe records a point of a series of the metric with the given key and returns the start
+// of the series.
+func (s *seriesStarts) observe(key string, fp model.Fingerprint, ts model.Time, value model.SampleValue) model.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	series, ok := s.series[key]
+	if !ok {
+		series = map[model.Fingerprint]seriesStart{}
+		s.series[key] = series
+	}
+	st, ok := series[fp]
+	switch {
+	case !ok:
+		st.start = ts
+	case value < st.value:
+		// the counter was reset some time after the last point
+		st.start = st.last
+	}
+	st.start = min(st.start, ts)
+	st.last, st.value = ts, value
+	series[fp] = st
+	return st.start
+}
+
+// retainMetrics forgets every metric not pushed with conf, once a reload removed it.
+func (s *seriesStarts) retainMetrics(conf *Config) {
+	configured := make(map[string]struct{}, len(conf.Metrics)+len(conf.DerivedMetrics))
+	for _, metric := range conf.Metrics {
+		configured[metric.key()] = struct{}{}
+	}
+	for _, d := range conf.DerivedMetrics {
+		configured[d.metric().key()] = struct{}{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.series {
+		if _, ok := configured[key]; !ok {
+			delete(s.series, key)
+		}
+	}
+}
+
+// retain forgets the series of the metric with the given key that are not in seen, so a
+// series that comes back starts over.
+func (s *seriesStarts) retain(key string, seen map[model.Fingerprint]struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fp := range s.series[key] {
+		if _, ok := seen[fp]; !ok {
+			delete(s.series[key], fp)
+		}
+	}
+}
+
+// batch prepares req to be pushed to the endpoint of conf.
+func (e *otlpExporter) batch(conf *OTLPConfig, req *colmetricspb.ExportMetricsServiceRequest) (pushBatch, error) {
+	b := pushBatch{
+		conf:    conf.PushConfig,
+		samples: countDataPoints(req),
+	}
+
+	switch conf.Protocol {
+	case OTLPProtocolHTTP:
+		body, err := proto.Marshal(req)
+		if err != nil {
+			return pushBatch{}, fmt.Errorf("failed to marshal export request: %w", err)
+		}
+		b.push = func(ctx context.Context, timeout time.Duration) error {
+			return e.attemptHTTP(ctx, conf, timeout, body)
+		}
+	default:
+		client, release, err := e.grpcClient(conf)
+		if err != nil {
+			return pushBatch{}, err
+		}
+		b.push = func(ctx context.Context, timeout time.Duration) error {
+			return attemptGRPC(ctx, client, conf, timeout, req)
+		}
+		b.release = release
+	}
+	return b, nil
+}
+
+// grpcClient returns a client for the endpoint of conf, and a func to call once it is no
+// longer used. The connection to an endpoint replaced by a reload is only closed once the
+// batches queued for it are done, so they are not canceled halfway.
+func (e *otlpExporter) grpcClient(conf *OTLPConfig) (colmetricspb.MetricsServiceClient, func(), error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := fmt.Sprintf("%s insecure=%t", conf.Endpoint, conf.Insecure)
+	c, ok := e.conns[key]
+	if !ok {
+		creds := credentials.NewTLS(nil)
+		if conf.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(conf.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create OTLP gRPC client: %w", err)
+		}
+		c = &otlpConn{conn: conn}
+		e.conns[key] = c
+	}
+	if key != e.connKey {
+		previous := e.connKey
+		e.connKey = key
+		e.closeUnused(previous)
+	}
+
+	c.batches++
+	release := sync.OnceFunc(func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		c.batches--
+		e.closeUnused(key)
+	})
+	return colmetricspb.NewMetricsServiceClient(c.conn), release, nil
+}
+
+// closeUnused closes the connection with the given key unless it is the current one or
+// batches still use it. Callers must hold e.mu.
+func (e *otlpExporter) closeUnused(key string) {
+	c, ok := e.conns[key]
+	if !ok || key == e.connKey || c.batches > 0 {
+		return
+	}
+	c.conn.Close()
+	delete(e.conns, key)
+}
+
+// close releases the gRPC connections, if any.
+func (e *otlpExporter) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, c := range e.conns {
+		c.conn.Close()
+		delete(e.conns, key)
+	}
+}
+
+// attemptGRPC exports req, treating the codes the OTLP spec lists as retryable as recoverable.
+func attemptGRPC(ctx context.Context, client colmetricspb.MetricsServiceClient, conf *OTLPConfig, timeout time.Duration, req *colmetricspb.ExportMetricsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if len(conf.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(conf.Headers))
+	}
+
+	_, err := client.Export(ctx, req)
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return recoverableError{err}
+	default:
+		return err
+	}
+}
+
+func (e *otlpExporter) attemptHTTP(ctx context.Context, conf *OTLPConfig, timeout time.Duration, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range conf.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "promql-to-scrape")
+
+	return doPush(e.client, req)
+}
+
+// buildOTLPRequest turns the samples of a refresh, and the points backfilled ahead of them,
+// into an OTLP export request. Counters become monotonic cumulative sums, with start times
+// from starts, everything else gauges. The labels in resourceLabels become resource
+// attributes, the rest data point attributes.
+func buildOTLPRequest(metrics []Metric, data Data, backfill map[string]model.Matrix, resourceLabels []string, starts *seriesStarts) *colmetricspb.ExportMetricsServiceRequest {
+	type resource struct {
+		scope   *metricspb.ScopeMetrics
+		metrics map[string]*metricspb.Metric
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	resources := map[string]*resource{}
+
+	for _, metric := range metrics {
+		samples, ok := data[metric.key()]
+		if !ok {
+			continue
+		}
+
+		seen := map[model.Fingerprint]struct{}{}
+		add := func(m model.Metric, ts model.Time, value model.SampleValue) {
+			labels := seriesLabels(metric, m)
+			fp := labels.Fingerprint()
+			seen[fp] = struct{}{}
+			attrs := model.LabelSet{}
+			for _, name := range resourceLabels {
+				if v, ok := labels[model.LabelName(name)]; ok {
+					attrs[model.LabelName(name)] = v
+					delete(labels, model.LabelName(name))
+				}
+			}
+
+			key := attrs.String()
+			r, ok := resources[key]
+			if !ok {
+				r = &resource{
+					scope:   &metricspb.ScopeMetrics{Scope: &commonpb.InstrumentationScope{Name: otlpScope}},
+					metrics: map[string]*metricspb.Metric{},
+				}
+				resources[key] = r
+				req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+					Resource: &resourcepb.Resource{
+						Attributes: append([]*commonpb.KeyValue{stringAttribute("service.name", otlpScope)}, toAttributes(attrs)...),
+					},
+					ScopeMetrics: []*metricspb.ScopeMetrics{r.scope},
+				})
+			}
+
+			om, ok := r.metrics[metric.MetricName]
+			if !ok {
+				om = newOTLPMetric(metric)
+				r.metrics[metric.MetricName] = om
+				r.scope.Metrics = append(r.scope.Metrics, om)
+			}
+
+			point := &metricspb.NumberDataPoint{
+				Attributes:   toAttributes(labels),
+				TimeUnixNano: uint64(ts.Time().UnixNano()),
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: float64(value)},
+			}
+			switch d := om.Data.(type) {
+			case *metricspb.Metric_Sum:
+				point.StartTimeUnixNano = uint64(starts.observe(metric.key(), fp, ts, value).Time().UnixNano())
+				d.Sum.DataPoints = append(d.Sum.DataPoints, point)
+			case *metricspb.Metric_Gauge:
+				d.Gauge.DataPoints = append(d.Gauge.DataPoints, point)
+			}
+		}
+
+		for _, stream := range backfill[metric.key()] {
+			for _, v := range stream.Values {
+				add(stream.Metric, v.Timestamp, v.Value)
+			}
+		}
+		for _, sample := range samples {
+			add(sample.Metric, sample.Timestamp, sample.Value)
+		}
+		if metric.Type == MetricTypeCounter {
+			starts.retain(metric.key(), seen)
+		}
+	}
+	return req
+}
+
+func newOTLPMetric(metric Metric) *metricspb.Metric {
+	om := &metricspb.Metric{
+		Name:        metric.MetricName,
+		Description: metric.help(),
+		Unit:        metric.Unit,
+	}
+	if metric.Type == MetricTypeCounter {
+		om.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+	} else {
+		om.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+	}
+	return om
+}
+
+// toAttributes returns labels as string attributes sorted by name.
+func toAttributes(labels model.LabelSet) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, stringAttribute(string(k), string(v)))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func countDataPoints(req *colmetricspb.ExportMetricsServiceRequest) int {
+	n := 0
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				n += len(m.GetGauge().GetDataPoints()) + len(m.GetSum().GetDataPoints())
+			}
+		}
+	}
+	return n
+}
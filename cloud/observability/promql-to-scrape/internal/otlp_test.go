@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsReceiver is a minimal OTLP receiver recording the requests it gets over gRPC and HTTP.
+type metricsReceiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	received []*colmetricspb.ExportMetricsServiceRequest
+	tenant   string
+}
+
+func (rcv *metricsReceiver) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.received = append(rcv.received, req)
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-tenant")) > 0 {
+		rcv.tenant = md.Get("x-tenant")[0]
+	}
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func (rcv *metricsReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req colmetricspb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.received = append(rcv.received, &req)
+	rcv.tenant = r.Header.Get("X-Tenant")
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+func TestOTLPExport(t *testing.T) {
+	metrics := []Metric{
+		{MetricName: "temporal_cloud_v0_poll_success_count", Type: MetricTypeCounter},
+		{MetricName: "temporal_cloud_v0_service_latency_p99", Unit: "seconds"},
+	}
+	data := Data{
+		metrics[0].MetricName: {
+			{Metric: model.Metric{"temporal_account": "acct", "temporal_namespace": "ns1"}, Timestamp: 3000, Value: 3},
+			{Metric: model.Metric{"temporal_account": "acct", "temporal_namespace": "ns2"}, Timestamp: 3000, Value: 4},
+		},
+		metrics[1].MetricName: {
+			{Metric: model.Metric{"temporal_account": "other", "operation": "StartWorkflowExecution"}, Timestamp: 3000, Value: 0.5},
+		},
+	}
+	backfill := map[string]model.Matrix{metrics[0].MetricName: {
+		{Metric: model.Metric{"temporal_account": "acct", "temporal_namespace": "ns1"}, Values: []model.SamplePair{{Timestamp: 2000, Value: 2}}},
+	}}
+
+	rcv := &metricsReceiver{}
+	srv := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(srv, rcv)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis) //nolint:errcheck // stopped below
+	defer srv.Stop()
+
+	httpSrv := httptest.NewServer(rcv)
+	defer httpSrv.Close()
+
+	testCases := []struct {
+		name string
+		conf *OTLPConfig
+	}{
+		{
+			name: "grpc",
+			conf: &OTLPConfig{Endpoint: lis.Addr().String(), Protocol: OTLPProtocolGRPC, Insecure: true},
+		},
+		{
+			name: "http",
+			conf: &OTLPConfig{Endpoint: httpSrv.URL + "/v1/metrics", Protocol: OTLPProtocolHTTP},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rcv.received = nil
+			tc.conf.ResourceLabels = []string{"temporal_account"}
+			tc.conf.PushConfig = PushConfig{Headers: map[string]string{"X-Tenant": "tenant"}, Timeout: 5 * time.Second}
+
+			e := newOTLPExporter(1)
+			defer e.close()
+			b, err := e.batch(tc.conf, buildOTLPRequest(metrics, data, backfill, tc.conf.ResourceLabels, e.starts))
+			if err != nil {
+				t.Fatalf("batch() = %v", err)
+			}
+			if b.samples != 4 {
+				t.Errorf("got %d data points, want 4", b.samples)
+			}
+			if err := e.send(context.Background(), b); err != nil {
+				t.Fatalf("send() = %v", err)
+			}
+
+			if len(rcv.received) != 1 {
+				t.Fatalf("got %d requests, want 1", len(rcv.received))
+			}
+			if rcv.tenant != "tenant" {
+				t.Errorf("got tenant header %q, want tenant", rcv.tenant)
+			}
+
+			resources := rcv.received[0].ResourceMetrics
+			if len(resources) != 2 {
+				t.Fatalf("got %d resources, want one per temporal_account", len(resources))
+			}
+			attrs := map[string]string{}
+			for _, kv := range resources[0].Resource.Attributes {
+				attrs[kv.Key] = kv.Value.GetStringValue()
+			}
+			if attrs["service.name"] != "promql-to-scrape" || attrs["temporal_account"] != "acct" {
+				t.Errorf("got resource attributes %v", attrs)
+			}
+
+			sum := resources[0].ScopeMetrics[0].Metrics[0].GetSum()
+			if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+				t.Fatalf("counter was not exported as a monotonic cumulative sum: %v", resources[0].ScopeMetrics[0].Metrics[0])
+			}
+			if got := len(sum.DataPoints); got != 3 {
+				t.Errorf("got %d sum data points, want 3", got)
+			}
+			for _, point := range sum.DataPoints {
+				// ns1 starts at its backfilled point, ns2 at its only one
+				wantStart := uint64(model.Time(2000).Time().UnixNano())
+				if point.Attributes[0].Value.GetStringValue() == "ns2" {
+					wantStart = uint64(model.Time(3000).Time().UnixNano())
+				}
+				if point.StartTimeUnixNano != wantStart {
+					t.Errorf("got start time %d on %v, want %d", point.StartTimeUnixNano, point, wantStart)
+				}
+				for _, kv := range point.Attributes {
+					if kv.Key == "temporal_account" {
+						t.Errorf("resource label left on data point %v", point)
+					}
+				}
+			}
+
+			gauge := resources[1].ScopeMetrics[0].Metrics[0]
+			if gauge.GetGauge() == nil || gauge.Unit != "seconds" {
+				t.Errorf("got %v, want a gauge in seconds", gauge)
+			}
+		})
+	}
+}
+
+func TestSeriesStarts(t *testing.T) {
+	type point struct {
+		ts    model.Time
+		value model.SampleValue
+	}
+	testCases := []struct {
+		name   string
+		points []point
+		want   []model.Time
+	}{
+		{
+			name:   "increasing",
+			points: []point{{1000, 1}, {2000, 3}, {3000, 3}},
+			want:   []model.Time{1000, 1000, 1000},
+		},
+		{
+			name:   "reset",
+			points: []point{{1000, 5}, {2000, 7}, {3000, 2}, {4000, 4}},
+			want:   []model.Time{1000, 1000, 2000, 2000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			starts := &seriesStarts{series: map[string]map[model.Fingerprint]seriesStart{}}
+			for i, p := range tc.points {
+				if got := starts.observe("m", 1, p.ts, p.value); got != tc.want[i] {
+					t.Errorf("point %d: got start %d, want %d", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+
+	starts := &seriesStarts{series: map[string]map[model.Fingerprint]seriesStart{}}
+	starts.observe("m", 1, 1000, 1)
+	starts.observe("m", 2, 1000, 1)
+	starts.retain("m", map[model.Fingerprint]struct{}{1: {}})
+	if got := starts.observe("m", 2, 5000, 2); got != 5000 {
+		t.Errorf("series missing from a refresh kept its start %d", got)
+	}
+	if got := starts.observe("m", 1, 5000, 2); got != 1000 {
+		t.Errorf("got start %d for a series in every refresh, want 1000", got)
+	}
+
+	starts.observe("removed", 1, 1000, 1)
+	conf, err := ParseConfig([]byte("metrics:\n  - metric_name: m\n    query: m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts.retainMetrics(conf)
+	if _, ok := starts.series["removed"]; ok {
+		t.Error("series of a metric no longer configured were kept")
+	}
+	if _, ok := starts.series["m"]; !ok {
+		t.Error("series of a configured metric were dropped")
+	}
+}
+
+func TestOTLPEndpointChangeKeepsQueuedBatches(t *testing.T) {
+	listen := func() (*metricsReceiver, string) {
+		rcv := &metricsReceiver{}
+		srv := grpc.NewServer()
+		colmetricspb.RegisterMetricsServiceServer(srv, rcv)
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(lis) //nolint:errcheck // stopped by cleanup
+		t.Cleanup(srv.Stop)
+		return rcv, lis.Addr().String()
+	}
+	oldRcv, oldAddr := listen()
+	newRcv, newAddr := listen()
+
+	metrics := []Metric{{MetricName: "a"}}
+	data := Data{"a": namespaceSamples("x")}
+	e := newOTLPExporter(2)
+	defer e.close()
+	for _, addr := range []string{oldAddr, newAddr} {
+		conf := &OTLPConfig{Endpoint: addr, Protocol: OTLPProtocolGRPC, Insecure: true, PushConfig: PushConfig{Timeout: 5 * time.Second}}
+		b, err := e.batch(conf, buildOTLPRequest(metrics, data, nil, nil, e.starts))
+		if err != nil {
+			t.Fatalf("batch() = %v", err)
+		}
+		e.enqueue(b)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.run(ctx)
+
+	received := func(rcv *metricsReceiver) int {
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		return len(rcv.received)
+	}
+	for deadline := time.Now().Add(5 * time.Second); received(oldRcv) == 0 || received(newRcv) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d pushes to the old endpoint and %d to the new one, want 1 each", received(oldRcv), received(newRcv))
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.conns[e.connKey]; len(e.conns) != 1 || !ok {
+		t.Errorf("got %d connections open, want only the one to the current endpoint", len(e.conns))
+	}
+}
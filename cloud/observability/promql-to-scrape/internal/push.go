@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
+)
+
+// Push targets, as reported in logs and the target label of the push metrics.
+const (
+	pushTargetRemoteWrite = "remote_write"
+	pushTargetOTLP        = "otlp"
+)
+
+// pushQueue pushes refreshes to a target in the background. Refreshes wait in a bounded queue
+// while the target is slow or down, so querying never blocks on it.
+type pushQueue struct {
+	target string
+	queue  chan pushBatch
+}
+
+// pushBatch is one refresh ready to be pushed, along with the config it is pushed with, so a
+// reload never applies to a push halfway through its retries.
+type pushBatch struct {
+	conf    PushConfig
+	samples int
+	// push makes a single attempt.
+	push func(ctx context.Context, timeout time.Duration) error
+	// release, if set, is called once the batch has been sent, has failed or was dropped.
+	release func()
+}
+
+// done calls the release func of b, if any.
+func (b pushBatch) done() {
+	if b.release != nil {
+		b.release()
+	}
+}
+
+// recoverableError marks pushes worth retrying.
+type recoverableError struct {
+	error
+}
+
+func newPushQueue(target string, capacity int) *pushQueue {
+	return &pushQueue{
+		target: target,
+		queue:  make(chan pushBatch, capacity),
+	}
+}
+
+// enqueue adds a refresh to the queue, dropping the oldest one if the queue is full.
+func (q *pushQueue) enqueue(b pushBatch) {
+	if b.samples == 0 {
+		b.done()
+		return
+	}
+	for {
+		select {
+		case q.queue <- b:
+			pushQueueLength.WithLabelValues(q.target).Set(float64(len(q.queue)))
+			return
+		default:
+		}
+		select {
+		case old := <-q.queue:
+			old.done()
+			pushSamples.WithLabelValues(q.target, "dropped").Add(float64(old.samples))
+			slog.Warn("push queue is full, dropping the oldest refresh", "target", q.target, "samples", old.samples)
+		default:
+		}
+	}
+}
+
+// run pushes queued refreshes until ctx is done. Whatever is still queued then is lost.
+func (q *pushQueue) run(ctx context.Context) {
+	for {
+		select {
+		case b := <-q.queue:
+			pushQueueLength.WithLabelValues(q.target).Set(float64(len(q.queue)))
+			err := q.send(ctx, b)
+			b.done()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				pushSamples.WithLabelValues(q.target, "failed").Add(float64(b.samples))
+				slog.Error("failed to push metrics", "target", q.target, "samples", b.samples, "error", err)
+				continue
+			}
+			pushSamples.WithLabelValues(q.target, "sent").Add(float64(b.samples))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send pushes b, retrying recoverable failures with exponential backoff.
+func (q *pushQueue) send(ctx context.Context, b pushBatch) error {
+	backoff := b.conf.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := b.push(ctx, b.conf.Timeout)
+		if err == nil {
+			return nil
+		}
+		var recoverable recoverableError
+		if !errors.As(err, &recoverable) || attempt >= b.conf.MaxRetries {
+			return err
+		}
+
+		pushRetries.WithLabelValues(q.target).Inc()
+		slog.Debug("retrying push", "target", q.target, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, b.conf.MaxBackoff)
+	}
+}
+
+// push queues the refresh of group, a subset of conf, for the push targets configured in conf.
+func (s *PromToScrapeServer) push(conf, group *Config, data Data, backfill map[string]model.Matrix) {
+	if conf.RemoteWrite != nil {
+		b, err := s.remoteWriter.batch(conf.RemoteWrite, buildWriteRequest(group.Metrics, data, backfill))
+		if err != nil {
+			slog.Error("failed to prepare push", "target", pushTargetRemoteWrite, "error", err)
+		} else {
+			s.remoteWriter.enqueue(b)
+		}
+	}
+	if conf.OTLP != nil {
+		b, err := s.otlpExporter.batch(conf.OTLP, buildOTLPRequest(group.Metrics, data, backfill, conf.OTLP.ResourceLabels, s.otlpExporter.starts))
+		if err != nil {
+			slog.Error("failed to prepare push", "target", pushTargetOTLP, "error", err)
+		} else {
+			s.otlpExporter.enqueue(b)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPushQueueDropsOldest(t *testing.T) {
+	q := newPushQueue(pushTargetRemoteWrite, 2)
+	for i := range 3 {
+		q.enqueue(pushBatch{samples: i + 1})
+	}
+
+	var got []int
+	for range 2 {
+		got = append(got, (<-q.queue).samples)
+	}
+	if want := []int{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got queued refreshes %v, want %v", got, want)
+	}
+}
@@ -1,25 +1,175 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
 )
 
+// Data holds the samples of each queried metric, keyed by metric name, qualified by the
+// account name as in "account/metric_name" for metrics of an account.
 type Data map[string][]*model.Sample
 
-func QueryMetrics(conf *Config, client *APIClient) (Data, error) {
+// QueryErrors holds the reason each failed metric could not be queried, keyed as Data is.
+type QueryErrors map[string]error
+
+// QueryDurations holds how long the query of each metric took, keyed as Data is. Metrics
+// taken from the cache or never queried are left out.
+type QueryDurations map[string]time.Duration
+
+type queryResult struct {
+	metric   Metric
+	samples  []*model.Sample
+	err      error
+	duration time.Duration
+}
+
+// QueryMetrics runs every configured query, fanned out over conf.Concurrency workers.
+// Each query is evaluated at the metric's offset and bounded by its timeout, and the whole
+// cycle by conf.CycleTimeout. Metrics sharing a query, offset and timeout are queried once,
+// and results are taken from cache, if not nil, when it has them.
+// Every configured metric ends up in exactly one of the returned Data or QueryErrors.
+func QueryMetrics(ctx context.Context, conf *Config, client Querier, cache Cache) (Data, QueryErrors, QueryDurations) {
+	ctx, cancel := context.WithTimeout(ctx, conf.CycleTimeout)
+	defer cancel()
+
+	type dedupKey struct {
+		query   string
+		offset  time.Duration
+		timeout time.Duration
+	}
+	var batches [][]Metric
+	index := map[dedupKey]int{}
+	for _, metric := range conf.Metrics {
+		key := dedupKey{metric.Query, *metric.Offset, metric.Timeout}
+		if i, ok := index[key]; ok {
+			batches[i] = append(batches[i], metric)
+			continue
+		}
+		index[key] = len(batches)
+		batches = append(batches, []Metric{metric})
+	}
+
+	jobs := make(chan []Metric)
+	results := make(chan queryResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(conf.Concurrency, len(batches)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for metrics := range jobs {
+				for _, result := range queryMetrics(ctx, conf, client, cache, metrics) {
+					results <- result
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, metrics := range batches {
+			select {
+			case jobs <- metrics:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
 	// https://pkg.go.dev/github.com/prometheus/common/model#Sample
 	queriedMetrics := map[string][]*model.Sample{}
+	errs := QueryErrors{}
+	durations := QueryDurations{}
+	for result := range results {
+		if result.duration > 0 {
+			durations[result.metric.key()] = result.duration
+		}
+		if result.err != nil {
+			errs[result.metric.key()] = result.err
+			continue
+		}
+		queriedMetrics[result.metric.key()] = result.samples
+	}
 
+	// metrics never handed to a worker because the cycle deadline passed
 	for _, metric := range conf.Metrics {
-		result, err := client.QueryMetricsInstant(metric.Query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to query for %s: %v", metric.MetricName, err)
+		_, ok := queriedMetrics[metric.key()]
+		if _, failed := errs[metric.key()]; !ok && !failed {
+			errs[metric.key()] = fmt.Errorf("refresh cycle did not finish within %s: %w", conf.CycleTimeout, ctx.Err())
+		}
+	}
+
+	return Data(queriedMetrics), errs, durations
+}
+
+// queryMetrics evaluates the query shared by metrics once, or takes its result from cache,
+// and returns the result of each metric.
+func queryMetrics(ctx context.Context, conf *Config, client Querier, cache Cache, metrics []Metric) []queryResult {
+	first := metrics[0]
+	ctx, cancel := context.WithTimeout(ctx, first.Timeout)
+	defer cancel()
+
+	ts := conf.evalTime(first, time.Now())
+	var key string
+	var result model.Vector
+	var cached bool
+	if cache != nil {
+		key = cacheKey(first.Account, first.Query, ts)
+		var err error
+		if result, cached, err = cache.Get(ctx, key); err != nil {
+			cacheRequests.WithLabelValues("error").Inc()
+			slog.Warn("failed to read query cache", "metric", first.MetricName, "error", err)
+		} else if cached {
+			cacheRequests.WithLabelValues("hit").Inc()
+		} else {
+			cacheRequests.WithLabelValues("miss").Inc()
 		}
+	}
 
-		queriedMetrics[metric.MetricName] = []*model.Sample(result)
+	var err error
+	var duration time.Duration
+	if !cached {
+		start := time.Now()
+		result, err = client.QueryMetricsInstant(ctx, first.Query, ts)
+		duration = time.Since(start)
+		for _, metric := range metrics {
+			queryDuration.WithLabelValues(metric.MetricName, metric.Account).Observe(duration.Seconds())
+		}
+		if err == nil && cache != nil {
+			// long enough for every replica to get to it within the alignment period
+			if err := cache.Set(ctx, key, result, 2*conf.Cache.align(first)); err != nil {
+				slog.Warn("failed to write query cache", "metric", first.MetricName, "error", err)
+			}
+		}
 	}
 
-	return Data(queriedMetrics), nil
+	results := make([]queryResult, 0, len(metrics))
+	for _, metric := range metrics {
+		if err != nil {
+			queryErrors.WithLabelValues(metric.MetricName, metric.Account).Inc()
+			results = append(results, queryResult{metric: metric, err: fmt.Errorf("failed to query for %s: %w", metric.MetricName, err), duration: duration})
+			continue
+		}
+		samples := relabelSamples(result, slices.Concat(conf.RelabelConfigs, metric.RelabelConfigs))
+		if metric.MaxSeries > 0 {
+			var err error
+			if samples, err = applySeriesLimit(metric, samples, metric.MaxSeries, seriesLimitMetric); err != nil {
+				results = append(results, queryResult{metric: metric, err: fmt.Errorf("too many series for %s: %w", metric.MetricName, err), duration: duration})
+				continue
+			}
+		}
+		results = append(results, queryResult{metric: metric, samples: samples, duration: duration})
+	}
+	return results
 }
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// scriptedQuerier answers instant queries by their text: "fail" errors, "block" waits for
+// the query to time out, "slow" takes a little while and anything else succeeds. It tracks
+// how many queries are in flight at once.
+type scriptedQuerier struct {
+	Querier
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (q *scriptedQuerier) QueryMetricsInstant(ctx context.Context, promql string, _ time.Time) (model.Vector, error) {
+	n := q.inFlight.Add(1)
+	defer q.inFlight.Add(-1)
+	for {
+		max := q.maxInFlight.Load()
+		if n <= max || q.maxInFlight.CompareAndSwap(max, n) {
+			break
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case promql == "fail":
+		return nil, errors.New("bad_data: parse error")
+	case promql == "block":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case strings.HasPrefix(promql, "slow"):
+		time.Sleep(20 * time.Millisecond)
+	}
+	return model.Vector{{Metric: model.Metric{"temporal_namespace": "ns", "temporal_service_type": "frontend"}, Value: 1}}, nil
+}
+
+// checkPartition fails t unless every metric of conf is in exactly one of data and errs.
+func checkPartition(t *testing.T, conf *Config, data Data, errs QueryErrors) {
+	t.Helper()
+	for _, metric := range conf.Metrics {
+		_, ok := data[metric.MetricName]
+		_, failed := errs[metric.MetricName]
+		if ok == failed {
+			t.Errorf("metric %q is in data: %t, in errors: %t, want exactly one", metric.MetricName, ok, failed)
+		}
+	}
+	if len(data)+len(errs) != len(conf.Metrics) {
+		t.Errorf("got %d results for %d metrics", len(data)+len(errs), len(conf.Metrics))
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+concurrency: 2
+metrics:
+  - metric_name: ok
+    query: ok
+  - metric_name: failing
+    query: fail
+  - metric_name: timing_out
+    query: block
+    timeout: 50ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, errs, durations := QueryMetrics(context.Background(), conf, &scriptedQuerier{}, nil)
+	checkPartition(t, conf, data, errs)
+
+	if got := data["ok"]; len(got) != 1 || got[0].Metric["temporal_service_type"] != "" {
+		t.Errorf("got %v for ok, want one series with temporal_service_type relabeled away", got)
+	}
+	if err := errs["failing"]; err == nil || !strings.Contains(err.Error(), "bad_data") {
+		t.Errorf("got error %v for failing, want the upstream error", err)
+	}
+	if err := errs["timing_out"]; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v for timing_out, want its timeout", err)
+	}
+	if d := durations["timing_out"]; d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("timing_out took %s, want about its 50ms timeout", d)
+	}
+}
+
+func TestQueryMetricsConcurrency(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+concurrency: 2
+metrics:
+  - {metric_name: a, query: slow_a}
+  - {metric_name: b, query: slow_b}
+  - {metric_name: c, query: slow_c}
+  - {metric_name: d, query: slow_d}
+  - {metric_name: e, query: slow_e}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &scriptedQuerier{}
+	data, errs, _ := QueryMetrics(context.Background(), conf, client, nil)
+	checkPartition(t, conf, data, errs)
+	if len(errs) > 0 {
+		t.Errorf("QueryMetrics() errors: %v", errs)
+	}
+	if got := client.maxInFlight.Load(); got != 2 {
+		t.Errorf("got %d queries in flight at once, want the concurrency of 2", got)
+	}
+}
+
+func TestQueryMetricsCycleDeadline(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+concurrency: 1
+cycle_timeout: 100ms
+query_timeout: 100ms
+metrics:
+  - {metric_name: blocking, query: block}
+  - {metric_name: never_run_a, query: a}
+  - {metric_name: never_run_b, query: b}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	data, errs, _ := QueryMetrics(context.Background(), conf, &scriptedQuerier{}, nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("QueryMetrics() took %s, want it bounded by the 100ms cycle_timeout", elapsed)
+	}
+	checkPartition(t, conf, data, errs)
+	for _, name := range []string{"never_run_a", "never_run_b"} {
+		// never handed to the worker, or handed to it right as the deadline passed
+		if err := errs[name]; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v for %s, want the cycle deadline", err, name)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// redisCache stores entries in a Redis compatible server, speaking just enough of the RESP
+// protocol for AUTH, SELECT, GET and SET over a single connection.
+type redisCache struct {
+	conf RedisConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisCache(conf RedisConfig) (*redisCache, error) {
+	if conf.PasswordFile != "" {
+		if _, err := readSecret("", conf.PasswordFile); err != nil {
+			return nil, fmt.Errorf("failed to read redis password: %w", err)
+		}
+	}
+	return &redisCache{conf: conf}, nil
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (model.Vector, bool, error) {
+	reply, err := c.do(ctx, "GET", c.conf.KeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+	var v model.Vector
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false, fmt.Errorf("failed to parse cache entry: %w", err)
+	}
+	return v, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, v model.Vector, ttl time.Duration) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "SET", c.conf.KeyPrefix+key, string(b), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (c *redisCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// do sends a command and returns its reply, connecting first if needed. The connection is
+// dropped on any network or protocol error, to be redialed by the next command.
+func (c *redisCache) do(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deadline := time.Now().Add(c.conf.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if c.conn == nil {
+		if err := c.connect(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(deadline, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *redisCache) connect(ctx context.Context, deadline time.Time) error {
+	d := net.Dialer{Deadline: deadline}
+	conn, err := d.DialContext(ctx, "tcp", c.conf.Address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	if c.conf.PasswordFile != "" {
+		password, err := readSecret("", c.conf.PasswordFile)
+		if err == nil {
+			auth := []string{"AUTH", password}
+			if c.conf.Username != "" {
+				auth = []string{"AUTH", c.conf.Username, password}
+			}
+			_, err = c.roundTrip(deadline, auth...)
+		}
+		if err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return fmt.Errorf("failed to authenticate with redis: %w", err)
+		}
+	}
+	if c.conf.DB != 0 {
+		if _, err := c.roundTrip(deadline, "SELECT", strconv.Itoa(c.conf.DB)); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return fmt.Errorf("failed to select redis db: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *redisCache) roundTrip(deadline time.Time, args ...string) (any, error) {
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(encodeRESPCommand(args)); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// encodeRESPCommand encodes args as a RESP array of bulk strings.
+func encodeRESPCommand(args []string) []byte {
+	b := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b
+}
+
+// readRESP reads one reply: a string for simple strings, an int64 for integers, []byte for
+// bulk strings, []any for arrays and nil for null replies. Error replies are returned as
+// redisError.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+}
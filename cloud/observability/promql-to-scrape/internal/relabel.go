@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+// defaultRelabelConfigs are used when the config has no global relabel_configs. They keep the
+// behaviour of earlier versions, which always dropped temporal_service_type.
+var defaultRelabelConfigs = func() []*relabel.Config {
+	cfg := relabel.DefaultRelabelConfig
+	cfg.Action = relabel.LabelDrop
+	cfg.Regex = relabel.MustNewRegexp("temporal_service_type")
+	cfg.NameValidationScheme = model.LegacyValidation
+	return []*relabel.Config{&cfg}
+}()
+
+// relabelSamples applies cfgs to the labels of each sample in order, like Prometheus does with
+// metric_relabel_configs. Samples dropped by a keep or drop rule are left out, and labels
+// starting with "__" (including __name__ and __rollup__) are removed afterwards.
+func relabelSamples(samples []*model.Sample, cfgs []*relabel.Config) []*model.Sample {
+	relabeled := make([]*model.Sample, 0, len(samples))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, s := range samples {
+		metric, keep := relabelMetric(lb, s.Metric, cfgs)
+		if !keep {
+			continue
+		}
+		relabeled = append(relabeled, &model.Sample{
+			Metric:    metric,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+			Histogram: s.Histogram,
+		})
+	}
+	return relabeled
+}
+
+// relabelStreams is relabelSamples for the result of a range query.
+func relabelStreams(matrix model.Matrix, cfgs []*relabel.Config) model.Matrix {
+	relabeled := make(model.Matrix, 0, len(matrix))
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for _, s := range matrix {
+		metric, keep := relabelMetric(lb, s.Metric, cfgs)
+		if !keep {
+			continue
+		}
+		relabeled = append(relabeled, &model.SampleStream{
+			Metric:     metric,
+			Values:     s.Values,
+			Histograms: s.Histograms,
+		})
+	}
+	return relabeled
+}
+
+func relabelMetric(lb *labels.Builder, m model.Metric, cfgs []*relabel.Config) (model.Metric, bool) {
+	lb.Reset(labels.EmptyLabels())
+	for k, v := range m {
+		lb.Set(string(k), string(v))
+	}
+	if !relabel.ProcessBuilder(lb, cfgs...) {
+		return nil, false
+	}
+
+	metric := model.Metric{}
+	lb.Range(func(l labels.Label) {
+		if !strings.HasPrefix(l.Name, model.ReservedLabelPrefix) {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+	})
+	return metric, true
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+func TestRelabelSamples(t *testing.T) {
+	samples := []*model.Sample{
+		{
+			Metric: model.Metric{
+				"__name__":              "temporal_cloud_v0_poll_success_count",
+				"__rollup__":            "true",
+				"temporal_namespace":    "ns1",
+				"temporal_service_type": "frontend",
+			},
+			Value: 1,
+		},
+		{
+			Metric: model.Metric{"temporal_namespace": "ns2"},
+			Value:  2,
+		},
+	}
+
+	testCases := []struct {
+		name string
+		cfgs string
+		want []model.Metric
+	}{
+		{
+			name: "defaults drop internal labels",
+			want: []model.Metric{
+				{"temporal_namespace": "ns1"},
+				{"temporal_namespace": "ns2"},
+			},
+		},
+		{
+			name: "rename and drop",
+			cfgs: `
+- action: labelmap
+  regex: temporal_(namespace)
+- action: labeldrop
+  regex: temporal_.*
+- action: drop
+  source_labels: [namespace]
+  regex: ns2
+`,
+			want: []model.Metric{
+				{"namespace": "ns1"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfgs := defaultRelabelConfigs
+			if tc.cfgs != "" {
+				cfgs = nil
+				if err := yaml.Unmarshal([]byte(tc.cfgs), &cfgs); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := validateRelabelConfigs(cfgs); err != nil {
+				t.Fatal(err)
+			}
+
+			got := relabelSamples(samples, cfgs)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d samples, want %d", len(got), len(tc.want))
+			}
+			for i := range got {
+				if !reflect.DeepEqual(got[i].Metric, tc.want[i]) {
+					t.Errorf("sample %d: got labels %v, want %v", i, got[i].Metric, tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/exp/slog"
+)
+
+// ReloadConfig re-reads the config file and swaps it in if it is valid, then triggers an
+// immediate refresh. The running config is kept if the new file fails to load.
+func (s *PromToScrapeServer) ReloadConfig() error {
+	return s.reloadConfig(true)
+}
+
+// reloadConfig does the work of ReloadConfig. Unless force is set, a file whose content has
+// not changed since the last load is left alone.
+func (s *PromToScrapeServer) reloadConfig(force bool) (err error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	defer func() {
+		if err != nil {
+			configReloads.WithLabelValues("failure").Inc()
+			configLastReloadSuccessful.Set(0)
+			slog.Error("failed to reload config, keeping the running one", "file", s.configFile, "error", err)
+		}
+	}()
+
+	bytes, err := os.ReadFile(s.configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	hash := sha256.Sum256(bytes)
+	if !force && hash == s.configHash {
+		return nil
+	}
+
+	conf, err := ParseConfig(bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := s.clients.check(conf); err != nil {
+		return err
+	}
+	if err := s.checkWeb(conf); err != nil {
+		return err
+	}
+	if err := s.caches.check(conf); err != nil {
+		return err
+	}
+
+	s.conf.Store(conf)
+	s.configHash = hash
+	s.otlpExporter.starts.retainMetrics(conf)
+	configReloads.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	slog.Info("reloaded config", "file", s.configFile, "metrics", len(conf.Metrics))
+
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// watchConfig reloads the config whenever its file changes, until ctx is done. The parent directory is watched
+// rather than the file itself so that atomic renames and Kubernetes ConfigMap symlink swaps
+// are picked up too.
+func (s *PromToScrapeServer) watchConfig(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("failed to watch config file, use SIGHUP or /-/reload to reload it", "error", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(s.configFile)); err != nil {
+		slog.Error("failed to watch config file, use SIGHUP or /-/reload to reload it", "error", err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// a removed or renamed file is followed by a create once it is replaced
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			s.reloadConfig(false) //nolint:errcheck // logged by reloadConfig
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("error watching config file", "error", err)
+		}
+	}
+}
+
+// reloadHandler is the HTTP handler for the "/-/reload" endpoint.
+func (s *PromToScrapeServer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.ReloadConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("metrics:\n  - metric_name: a\n    query: a\n")
+	s, err := NewPromToScrapeServer(&scriptedQuerier{}, configFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPromToScrapeServer() = %v", err)
+	}
+	original := s.conf.Load()
+	s.otlpExporter.starts.observe("a", 1, 1000, 1)
+
+	testCases := []struct {
+		name        string
+		config      string
+		method      string
+		wantCode    int
+		wantMetric  string
+		wantRefresh bool
+	}{
+		{
+			name:       "not a POST",
+			config:     "metrics:\n  - metric_name: b\n    query: b\n",
+			method:     http.MethodGet,
+			wantCode:   http.StatusMethodNotAllowed,
+			wantMetric: "a",
+		},
+		{
+			name:       "malformed file",
+			config:     "metrics: [\n",
+			method:     http.MethodPost,
+			wantCode:   http.StatusInternalServerError,
+			wantMetric: "a",
+		},
+		{
+			name:       "invalid config",
+			config:     "metrics:\n  - metric_name: b\n",
+			method:     http.MethodPost,
+			wantCode:   http.StatusInternalServerError,
+			wantMetric: "a",
+		},
+		{
+			name:        "valid config",
+			config:      "metrics:\n  - metric_name: b\n    query: b\n",
+			method:      http.MethodPost,
+			wantCode:    http.StatusOK,
+			wantMetric:  "b",
+			wantRefresh: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			writeConfig(tc.config)
+			rec := httptest.NewRecorder()
+			s.reloadHandler(rec, httptest.NewRequest(tc.method, "/-/reload", nil))
+
+			if rec.Code != tc.wantCode {
+				t.Errorf("got status %d, want %d", rec.Code, tc.wantCode)
+			}
+			if tc.wantCode == http.StatusMethodNotAllowed && rec.Header().Get("Allow") != http.MethodPost {
+				t.Errorf("got Allow %q, want POST", rec.Header().Get("Allow"))
+			}
+			if got := s.conf.Load().Metrics[0].MetricName; got != tc.wantMetric {
+				t.Errorf("serving metric %q, want %q", got, tc.wantMetric)
+			}
+			if tc.wantMetric == "a" && s.conf.Load() != original {
+				t.Error("the running config was replaced")
+			}
+			if _, ok := s.otlpExporter.starts.series["a"]; ok != (tc.wantMetric == "a") {
+				t.Errorf("series starts of a kept = %t, want %t", ok, tc.wantMetric == "a")
+			}
+
+			refreshed := false
+			select {
+			case <-s.refresh:
+				refreshed = true
+			default:
+			}
+			if refreshed != tc.wantRefresh {
+				t.Errorf("refresh triggered = %t, want %t", refreshed, tc.wantRefresh)
+			}
+		})
+	}
+
+	// a watcher event for a file whose content did not change is a no-op
+	current := s.conf.Load()
+	if err := s.reloadConfig(false); err != nil || s.conf.Load() != current {
+		t.Errorf("reloadConfig(false) of an unchanged file = %v, replaced config %t", err, s.conf.Load() != current)
+	}
+}
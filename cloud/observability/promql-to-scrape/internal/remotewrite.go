@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteWriter pushes refreshes with the Prometheus remote_write protocol.
+type remoteWriter struct {
+	client *http.Client
+	*pushQueue
+}
+
+func newRemoteWriter(capacity int) *remoteWriter {
+	return &remoteWriter{
+		client:    &http.Client{},
+		pushQueue: newPushQueue(pushTargetRemoteWrite, capacity),
+	}
+}
+
+// batch prepares req to be pushed to the endpoint of conf.
+func (w *remoteWriter) batch(conf *RemoteWriteConfig, req *prompb.WriteRequest) (pushBatch, error) {
+	raw, err := req.Marshal()
+	if err != nil {
+		return pushBatch{}, fmt.Errorf("failed to marshal write request: %w", err)
+	}
+	body := snappy.Encode(nil, raw)
+
+	return pushBatch{
+		conf:    conf.PushConfig,
+		samples: countSamples(req),
+		push: func(ctx context.Context, timeout time.Duration) error {
+			return w.attempt(ctx, conf, timeout, body)
+		},
+	}, nil
+}
+
+func (w *remoteWriter) attempt(ctx context.Context, conf *RemoteWriteConfig, timeout time.Duration, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range conf.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "promql-to-scrape")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	return doPush(w.client, req)
+}
+
+// doPush sends req, treating 5xx, 429 and network errors as recoverable.
+func doPush(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body) //nolint:errcheck // only drained to reuse the connection
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// buildWriteRequest turns the samples of a refresh, and the points backfilled ahead of them,
+// into a remote_write request with one time series per label set.
+func buildWriteRequest(metrics []Metric, data Data, backfill map[string]model.Matrix) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+	for _, metric := range metrics {
+		samples, ok := data[metric.key()]
+		if !ok {
+			continue
+		}
+
+		series := map[model.Fingerprint]*prompb.TimeSeries{}
+		var order []model.Fingerprint
+		add := func(m model.Metric, ts model.Time, value model.SampleValue) {
+			labels := seriesLabels(metric, m)
+			labels[model.MetricNameLabel] = model.LabelValue(metric.MetricName)
+			fp := labels.Fingerprint()
+			s, ok := series[fp]
+			if !ok {
+				s = &prompb.TimeSeries{Labels: toLabelPairs(labels)}
+				series[fp] = s
+				order = append(order, fp)
+			}
+			s.Samples = append(s.Samples, prompb.Sample{Timestamp: int64(ts), Value: float64(value)})
+		}
+		for _, stream := range backfill[metric.key()] {
+			for _, v := range stream.Values {
+				add(stream.Metric, v.Timestamp, v.Value)
+			}
+		}
+		for _, sample := range samples {
+			add(sample.Metric, sample.Timestamp, sample.Value)
+		}
+
+		for _, fp := range order {
+			req.Timeseries = append(req.Timeseries, *series[fp])
+		}
+		req.Metadata = append(req.Metadata, prompb.MetricMetadata{
+			Type:             metric.remoteWriteType(),
+			MetricFamilyName: metric.MetricName,
+			Help:             metric.help(),
+			Unit:             metric.Unit,
+		})
+	}
+	return req
+}
+
+// toLabelPairs returns labels sorted by name, as remote_write requires.
+func toLabelPairs(labels model.LabelSet) []prompb.Label {
+	pairs := make([]prompb.Label, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, prompb.Label{Name: string(k), Value: string(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+func countSamples(req *prompb.WriteRequest) int {
+	n := 0
+	for _, ts := range req.Timeseries {
+		n += len(ts.Samples)
+	}
+	return n
+}
+
+func (m Metric) remoteWriteType() prompb.MetricMetadata_MetricType {
+	switch m.Type {
+	case MetricTypeCounter:
+		return prompb.MetricMetadata_COUNTER
+	case MetricTypeUntyped:
+		return prompb.MetricMetadata_UNKNOWN
+	default:
+		return prompb.MetricMetadata_GAUGE
+	}
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// writeReceiver is a minimal remote_write receiver. It answers its first failures requests with
+// status, and decodes and records the ones after.
+type writeReceiver struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	attempts int
+	received []*prompb.WriteRequest
+	headers  http.Header
+}
+
+func (rcv *writeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.attempts++
+	if rcv.attempts <= rcv.failures {
+		http.Error(w, "try again", rcv.status)
+		return
+	}
+
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rcv.received = append(rcv.received, &req)
+	rcv.headers = r.Header.Clone()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	metric := Metric{
+		MetricName: "temporal_cloud_v0_poll_success_count",
+		Type:       MetricTypeCounter,
+		Labels:     map[string]string{"env": "prod"},
+	}
+	data := Data{metric.MetricName: {
+		{Metric: model.Metric{"temporal_namespace": "ns1"}, Timestamp: 3000, Value: 3},
+	}}
+	backfill := map[string]model.Matrix{metric.MetricName: {
+		{Metric: model.Metric{"temporal_namespace": "ns1"}, Values: []model.SamplePair{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}},
+	}}
+
+	testCases := []struct {
+		name         string
+		failures     int
+		status       int
+		wantAttempts int
+		wantReceived bool
+	}{
+		{
+			name:         "accepted",
+			wantAttempts: 1,
+			wantReceived: true,
+		},
+		{
+			name:         "retries server errors",
+			failures:     2,
+			status:       http.StatusServiceUnavailable,
+			wantAttempts: 3,
+			wantReceived: true,
+		},
+		{
+			name:         "gives up after max retries",
+			failures:     10,
+			status:       http.StatusTooManyRequests,
+			wantAttempts: 4,
+		},
+		{
+			name:         "does not retry client errors",
+			failures:     1,
+			status:       http.StatusBadRequest,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rcv := &writeReceiver{failures: tc.failures, status: tc.status}
+			srv := httptest.NewServer(rcv)
+			defer srv.Close()
+
+			conf := &RemoteWriteConfig{
+				URL: srv.URL,
+				PushConfig: PushConfig{
+					Headers:    map[string]string{"X-Scope-OrgID": "tenant"},
+					Timeout:    time.Second,
+					MaxRetries: 3,
+					MinBackoff: time.Millisecond,
+					MaxBackoff: 2 * time.Millisecond,
+				},
+			}
+			w := newRemoteWriter(1)
+			b, err := w.batch(conf, buildWriteRequest([]Metric{metric}, data, backfill))
+			if err != nil {
+				t.Fatalf("batch() = %v", err)
+			}
+			err = w.send(context.Background(), b)
+
+			if rcv.attempts != tc.wantAttempts {
+				t.Errorf("got %d attempts, want %d", rcv.attempts, tc.wantAttempts)
+			}
+			if !tc.wantReceived {
+				if err == nil {
+					t.Error("send() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send() = %v", err)
+			}
+
+			if got := rcv.headers.Get("X-Scope-OrgID"); got != "tenant" {
+				t.Errorf("X-Scope-OrgID = %q, want tenant", got)
+			}
+			if got := rcv.headers.Get("Content-Encoding"); got != "snappy" {
+				t.Errorf("Content-Encoding = %q, want snappy", got)
+			}
+
+			got := rcv.received[0]
+			wantSeries := []prompb.TimeSeries{{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: metric.MetricName},
+					{Name: "env", Value: "prod"},
+					{Name: "temporal_namespace", Value: "ns1"},
+				},
+				Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}, {Timestamp: 3000, Value: 3}},
+			}}
+			if !reflect.DeepEqual(got.Timeseries, wantSeries) {
+				t.Errorf("got series %v, want %v", got.Timeseries, wantSeries)
+			}
+			if len(got.Metadata) != 1 || got.Metadata[0].Type != prompb.MetricMetadata_COUNTER || got.Metadata[0].MetricFamilyName != metric.MetricName {
+				t.Errorf("got metadata %v, want a counter named %s", got.Metadata, metric.MetricName)
+			}
+		})
+	}
+}
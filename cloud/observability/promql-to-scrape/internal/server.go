@@ -1,92 +1,448 @@
 package internal
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 	"golang.org/x/exp/slog"
 )
 
+// shutdownTimeout bounds how long in-flight HTTP requests are given to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 type PromToScrapeServer struct {
-	client             *APIClient
-	conf               *Config
-	server             http.Server
-	data               string
-	lastSuccessfulTime time.Time
+	clients    *Clients
+	caches     caches
+	configFile string
+	conf       atomic.Pointer[Config]
+	configHash [sha256.Size]byte
+	reloadMu   sync.Mutex
+	refresh    chan struct{}
+	server     http.Server
+	metrics    map[string]*metricState
+	handler    http.Handler
+	registry   *prometheus.Registry
+	// listenerTLS is set when the listener serves HTTPS.
+	listenerTLS *listenerTLS
+	// remoteWriter and otlpExporter push refreshes when remote_write and otlp are configured.
+	remoteWriter *remoteWriter
+	otlpExporter *otlpExporter
+
+	// groups tracks the refreshes of each group of metrics refreshed together, for /readyz.
+	groups map[groupKey]*groupState
+	// lastEvaluated is when each metric was last successfully evaluated, used to find gaps
+	// to backfill. stateMu serializes writes of it to the backfill state file.
+	lastEvaluated map[string]time.Time
+	stateMu       sync.Mutex
 
 	sync.RWMutex
 }
 
-func NewPromToScrapeServer(client *APIClient, conf *Config, addr string) *PromToScrapeServer {
+// metricState tracks the last good samples and the last error of a single configured metric.
+type metricState struct {
+	metric      Metric
+	samples     []*model.Sample
+	lastSuccess time.Time
+	lastError   error
+	lastAttempt time.Time
+	// lastDuration is how long the last query took, 0 if it was served from the cache.
+	lastDuration time.Duration
+	// backfill holds the points filling the gap before the last refresh, if any.
+	backfill model.Matrix
+}
+
+// groupState tracks the refreshes of one group of metrics sharing an account and interval.
+type groupState struct {
+	// lastSuccessfulRefresh is the last refresh of the group in which at least one query succeeded.
+	lastSuccessfulRefresh time.Time
+	// upstreamReachable reports whether the last refresh of the group got any query through.
+	upstreamReachable bool
+}
+
+// NewPromToScrapeServer loads configFile and prepares a server for the metrics it lists.
+// client queries the top-level metrics and may be nil if the config only has accounts.
+// Nothing is queried or served until Run is called.
+func NewPromToScrapeServer(client Querier, configFile string, addr string) (*PromToScrapeServer, error) {
 	s := &PromToScrapeServer{
-		client: client,
-		conf:   conf,
-		data:   "",
+		clients:    NewClients(client),
+		configFile: configFile,
+		refresh:    make(chan struct{}, 1),
+		metrics:    map[string]*metricState{},
+		groups:     map[groupKey]*groupState{},
+	}
+
+	bytes, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	conf, err := ParseConfig(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if err := s.clients.check(conf); err != nil {
+		return nil, err
+	}
+	if err := s.caches.check(conf); err != nil {
+		return nil, err
 	}
+	s.conf.Store(conf)
+	s.configHash = sha256.Sum256(bytes)
+
+	s.lastEvaluated = map[string]time.Time{}
+	if conf.Backfill.Enabled && conf.Backfill.StateFile != "" {
+		if s.lastEvaluated, err = loadBackfillState(conf.Backfill.StateFile); err != nil {
+			return nil, err
+		}
+	}
+
+	remoteWriteCapacity, otlpCapacity := defaultPushQueueCapacity, defaultPushQueueCapacity
+	if conf.RemoteWrite != nil {
+		remoteWriteCapacity = conf.RemoteWrite.QueueCapacity
+	}
+	if conf.OTLP != nil {
+		otlpCapacity = conf.OTLP.QueueCapacity
+	}
+	s.remoteWriter = newRemoteWriter(remoteWriteCapacity)
+	s.otlpExporter = newOTLPExporter(otlpCapacity)
+
+	s.registry = prometheus.NewRegistry()
+	s.registry.MustRegister(sampleCollector{s})
+	s.handler = expositionHandler{prometheus.GathererFunc(s.gather)}
+	states := prometheus.NewRegistry()
+	states.MustRegister(stateCollector{s})
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.Handle("/internal/metrics", internalMetricsHandler(states))
+	mux.HandleFunc("/-/reload", s.reloadHandler)
+	mux.HandleFunc("/status", s.statusHandler)
+	mux.HandleFunc("/api/v1/targets", s.targetsHandler)
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/metrics", http.StatusMovedPermanently)
 	})
 
 	s.server = http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: s.authenticate(mux),
+	}
+	if conf.Web.TLS != nil {
+		s.listenerTLS = &listenerTLS{conf: func() *ListenerTLSConfig { return s.conf.Load().Web.TLS }}
+		if _, err := s.listenerTLS.get(conf.Web.TLS); err != nil {
+			return nil, err
+		}
+		s.server.TLSConfig = &tls.Config{GetConfigForClient: s.listenerTLS.getConfigForClient}
+	}
+	if err := s.checkWeb(conf); err != nil {
+		return nil, err
 	}
 
-	go s.run()
-
-	return s
+	return s, nil
 }
 
 // metricsHandler is the HTTP handler for the "/metrics" endpoint.
+// Metrics whose last query failed keep serving their last good samples until those go stale.
 func (s *PromToScrapeServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	conf := s.conf.Load()
+	if conf.DisableMetricsEndpoint {
+		http.Error(w, "/metrics is disabled, metrics are only pushed", http.StatusNotFound)
+		return
+	}
+	if !s.hasFreshData(conf, time.Now()) {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("can't serve metrics", "error", "too many metrics queried are stale", "staleness_threshold", conf.StalenessThreshold, "min_fresh_ratio", *conf.MinFreshRatio)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// gather collects the queried series and attaches the configured units to their families.
+func (s *PromToScrapeServer) gather() ([]*dto.MetricFamily, error) {
+	mfs, err := s.registry.Gather()
+	conf := s.conf.Load()
+
 	s.RLock()
 	defer s.RUnlock()
-	if time.Since(s.lastSuccessfulTime) < 5*time.Minute {
-		fmt.Fprint(w, s.data)
-	} else {
-		w.WriteHeader(http.StatusInternalServerError)
-		slog.Error("can't serve metrics", "error", "metrics queried are stale (more than 5 minutes old)")
+	if conf.Backfill.Enabled {
+		mfs = addBackfill(mfs, s.metrics, conf.StalenessThreshold, time.Now())
+	}
+	units := map[string]string{}
+	for _, state := range s.metrics {
+		if state.metric.Unit != "" {
+			units[state.metric.MetricName] = state.metric.Unit
+		}
+	}
+	for _, mf := range mfs {
+		if unit, ok := units[mf.GetName()]; ok {
+			mf.Unit = &unit
+		}
+	}
+	return mfs, err
+}
+
+// hasFreshData reports whether at least min_fresh_ratio of the metrics of conf, derived ones
+// included, have samples younger than the staleness threshold. Without metrics there is
+// nothing to be stale, so it is always true.
+func (s *PromToScrapeServer) hasFreshData(conf *Config, now time.Time) bool {
+	keys := make([]string, 0, len(conf.Metrics)+len(conf.DerivedMetrics))
+	for _, metric := range conf.Metrics {
+		keys = append(keys, metric.key())
+	}
+	for _, d := range conf.DerivedMetrics {
+		keys = append(keys, d.metric().key())
+	}
+	if len(keys) == 0 {
+		return true
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	fresh := 0
+	for _, key := range keys {
+		if state, ok := s.metrics[key]; ok && !state.lastSuccess.IsZero() && now.Sub(state.lastSuccess) < conf.StalenessThreshold {
+			fresh++
+		}
 	}
+	return float64(fresh) >= *conf.MinFreshRatio*float64(len(keys))
 }
 
-// Run on loop getting the metrics data we need
-func (s *PromToScrapeServer) run() string {
-	s.queryMetrics()
-	// to provide some jitter
-	ticker := time.NewTicker(59 * time.Second)
+// run refreshes each group of metrics sharing an account and interval on its own ticker,
+// until ctx is done. The groups are rebuilt from the current config whenever it is reloaded.
+// All groups share conf.Concurrency slots for their queries.
+func (s *PromToScrapeServer) run(ctx context.Context) {
+	for {
+		conf := s.conf.Load()
+		groupCtx, cancel := context.WithCancel(ctx)
+		slots := make(chan struct{}, conf.Concurrency)
+
+		var wg sync.WaitGroup
+		groups := conf.groupBySchedule()
+		s.Lock()
+		for key := range s.groups {
+			if _, ok := groups[key]; !ok {
+				delete(s.groups, key)
+			}
+		}
+		s.Unlock()
+		for key, metrics := range groups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.runGroup(groupCtx, conf, key, metrics, slots)
+			}()
+		}
+		if len(groups) == 0 {
+			// nothing to query, but the refresh itself succeeded
+			s.queryMetrics(groupCtx, conf, groupKey{}, conf, nil)
+		}
+
+		select {
+		case <-s.refresh:
+		case <-ctx.Done():
+		}
+		cancel()
+		wg.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// runGroup refreshes the metrics of an account every interval until ctx is done. Each query
+// takes one of slots while in flight.
+func (s *PromToScrapeServer) runGroup(ctx context.Context, conf *Config, key groupKey, metrics []Metric, slots chan struct{}) {
+	client, err := s.clients.get(conf, key.account)
+	if err != nil {
+		// checked when the config was loaded, so only a bug gets here
+		slog.Error("can't refresh metrics", "account", key.account, "error", err)
+		return
+	}
+	client = limitedQuerier{Querier: client, slots: slots}
+
+	group := conf.group(key, metrics)
+	s.queryMetrics(ctx, conf, key, group, client)
+	ticker := time.NewTicker(key.interval)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			s.queryMetrics()
+			s.queryMetrics(ctx, conf, key, group, client)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// there's an alternate way to implement this:
-//
-//	keep the objects returned from the query, or convert them into something a bit more ergonomic
-//	and create ConstMetrics with the prometheus client. I happened to have the code lying around for working
-//	with model.Sample, but the CosntMetrics route is probably more idiomatic and safe.
-func (s *PromToScrapeServer) queryMetrics() {
+// queryMetrics refreshes the metrics of group, a subset of conf identified by key, through
+// client. The samples are kept as-is and turned into const metrics by sampleCollector at
+// scrape time.
+func (s *PromToScrapeServer) queryMetrics(ctx context.Context, conf *Config, key groupKey, group *Config, client Querier) {
 	start := time.Now()
-	queriedMetrics, err := QueryMetrics(s.conf, s.client)
-	if err != nil {
-		slog.Error("failed to query metrics", "error", err)
+	queriedMetrics, errs, durations := QueryMetrics(ctx, group, client, s.caches.get())
+	if ctx.Err() != nil {
+		// shutting down or reloading, the errors only say the queries were canceled
 		return
 	}
+	for name, err := range errs {
+		slog.Warn("failed to query metric", "metric", name, "error", err)
+	}
+
+	var backfill map[string]model.Matrix
+	if conf.Backfill.Enabled {
+		backfill = s.backfillGaps(ctx, conf, group, client, queriedMetrics, start)
+	}
+
+	now := time.Now()
+	failed := len(queriedMetrics) == 0 && len(errs) > 0
 	s.Lock()
-	s.data = SamplesToString(queriedMetrics)
-	s.lastSuccessfulTime = time.Now()
+	s.limitGlobalSeries(conf, group, queriedMetrics, errs, now)
+	s.updateStates(conf, queriedMetrics, errs, durations, now)
+	derived := s.evaluateDerived(conf, group, queriedMetrics, now)
+	for _, metric := range group.Metrics {
+		if _, ok := queriedMetrics[metric.key()]; ok {
+			s.metrics[metric.key()].backfill = backfill[metric.key()]
+			s.lastEvaluated[metric.key()] = conf.evalTime(metric, start)
+		}
+	}
+	state, ok := s.groups[key]
+	if !ok {
+		state = &groupState{}
+		s.groups[key] = state
+	}
+	state.upstreamReachable = !failed
+	if !failed {
+		state.lastSuccessfulRefresh = now
+	}
 	s.Unlock()
-	slog.Debug("successful metric retrieval", "time", time.Since(start))
+	s.saveLastEvaluated(conf)
+	pushGroup := group
+	if len(derived) > 0 {
+		withDerived := *group
+		withDerived.Metrics = slices.Concat(group.Metrics, derived)
+		pushGroup = &withDerived
+	}
+	s.push(conf, pushGroup, queriedMetrics, backfill)
+
+	if failed {
+		slog.Error("failed to query metrics", "failed", len(errs))
+		return
+	}
+	lastRefresh.Set(float64(now.Unix()))
+	slog.Debug("successful metric retrieval", "time", time.Since(start), "succeeded", len(queriedMetrics), "failed", len(errs))
+}
+
+// updateStates merges the outcome of a refresh into the per-metric state, dropping metrics
+// that are no longer in conf. Metrics missing from both data and errs were not part of the
+// refresh and keep their state. Callers must hold the write lock.
+func (s *PromToScrapeServer) updateStates(conf *Config, data Data, errs QueryErrors, durations QueryDurations, now time.Time) {
+	configured := make(map[string]Metric, len(conf.Metrics)+len(conf.DerivedMetrics))
+	for _, metric := range conf.Metrics {
+		configured[metric.key()] = metric
+	}
+	for _, d := range conf.DerivedMetrics {
+		configured[d.metric().key()] = d.metric()
+	}
+	for key := range s.metrics {
+		if _, ok := configured[key]; !ok {
+			delete(s.metrics, key)
+		}
+	}
+	for key := range s.lastEvaluated {
+		if _, ok := configured[key]; !ok {
+			delete(s.lastEvaluated, key)
+		}
+	}
+
+	for key, metric := range configured {
+		state, ok := s.metrics[key]
+		if !ok {
+			state = &metricState{}
+			s.metrics[key] = state
+		}
+		state.metric = metric
+		if samples, ok := data[key]; ok {
+			state.samples = samples
+			state.lastSuccess = now
+			state.lastError = nil
+			state.lastAttempt = now
+			state.lastDuration = durations[key]
+		} else if err, ok := errs[key]; ok {
+			state.lastError = err
+			state.lastAttempt = now
+			state.lastDuration = durations[key]
+		}
+	}
 }
 
-// Start runs the embedded http.Server.
-func (s *PromToScrapeServer) Start() error {
-	return s.server.ListenAndServe()
+// Run serves HTTP and refreshes metrics until ctx is done. It then cancels in-flight queries
+// and pushes, stops watching the config file and gives open HTTP requests shutdownTimeout to finish.
+func (s *PromToScrapeServer) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		s.run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.watchConfig(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.remoteWriter.run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.otlpExporter.run(ctx)
+	}()
+	defer s.otlpExporter.close()
+	defer s.caches.close()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if s.server.TLSConfig != nil {
+			// the certificates come from TLSConfig
+			serveErr <- s.server.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- s.server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		// the listener failed, take the background work down with it
+		cancel()
+	case <-ctx.Done():
+		slog.Info("shutting down")
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelShutdown()
+		if shutdownErr := s.server.Shutdown(shutdownCtx); shutdownErr != nil {
+			err = fmt.Errorf("failed to shut down HTTP server: %w", shutdownErr)
+		}
+	}
+
+	wg.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,443 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+func namespaceSamples(namespaces ...string) []*model.Sample {
+	samples := make([]*model.Sample, 0, len(namespaces))
+	for _, ns := range namespaces {
+		samples = append(samples, &model.Sample{Metric: model.Metric{"temporal_namespace": model.LabelValue(ns)}, Value: 1})
+	}
+	return samples
+}
+
+func TestUpdateStates(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+metrics:
+  - metric_name: a
+    query: a
+  - metric_name: b
+    query: b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Unix(1000, 0)
+	now := before.Add(time.Minute)
+	queryErr := errors.New("query timed out")
+
+	testCases := []struct {
+		name        string
+		data        Data
+		errs        QueryErrors
+		wantSamples int
+		wantSuccess time.Time
+		wantAttempt time.Time
+		wantErr     error
+	}{
+		{
+			name:        "success replaces the samples",
+			data:        Data{"a": namespaceSamples("x", "y", "z")},
+			wantSamples: 3,
+			wantSuccess: now,
+			wantAttempt: now,
+		},
+		{
+			name:        "failure keeps the last good samples",
+			errs:        QueryErrors{"a": queryErr},
+			wantSamples: 1,
+			wantSuccess: before,
+			wantAttempt: now,
+			wantErr:     queryErr,
+		},
+		{
+			name:        "metric left out of the refresh keeps its state",
+			data:        Data{"b": namespaceSamples("x")},
+			wantSamples: 1,
+			wantSuccess: before,
+			wantAttempt: before,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &PromToScrapeServer{
+				metrics: map[string]*metricState{
+					"a":       {samples: namespaceSamples("x"), lastSuccess: before, lastAttempt: before},
+					"removed": {lastSuccess: before},
+				},
+				lastEvaluated: map[string]time.Time{"a": before, "removed": before},
+			}
+			s.updateStates(conf, tc.data, tc.errs, nil, now)
+
+			if _, ok := s.metrics["removed"]; ok {
+				t.Error("state of a metric no longer configured was kept")
+			}
+			if _, ok := s.lastEvaluated["removed"]; ok {
+				t.Error("last evaluation of a metric no longer configured was kept")
+			}
+			if _, ok := s.lastEvaluated["a"]; !ok {
+				t.Error("last evaluation of a configured metric was dropped")
+			}
+			state := s.metrics["a"]
+			if len(state.samples) != tc.wantSamples {
+				t.Errorf("got %d samples, want %d", len(state.samples), tc.wantSamples)
+			}
+			if !state.lastSuccess.Equal(tc.wantSuccess) || !state.lastAttempt.Equal(tc.wantAttempt) {
+				t.Errorf("got last success %s and attempt %s, want %s and %s", state.lastSuccess, state.lastAttempt, tc.wantSuccess, tc.wantAttempt)
+			}
+			if state.lastError != tc.wantErr {
+				t.Errorf("got last error %v, want %v", state.lastError, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSampleCollector(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+staleness_threshold: 5m
+metrics:
+  - metric_name: fresh
+    query: fresh
+  - metric_name: failing
+    query: failing
+  - metric_name: stale
+    query: stale
+  - metric_name: pending
+    query: pending
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	s := &PromToScrapeServer{metrics: map[string]*metricState{
+		"fresh":   {metric: conf.Metrics[0], samples: namespaceSamples("a", "b"), lastSuccess: now.Add(-10 * time.Second)},
+		"failing": {metric: conf.Metrics[1], samples: namespaceSamples("a"), lastSuccess: now.Add(-2 * time.Minute), lastError: errors.New("timeout")},
+		"stale":   {metric: conf.Metrics[2], samples: namespaceSamples("a"), lastSuccess: now.Add(-10 * time.Minute), lastError: errors.New("timeout")},
+		"pending": {metric: conf.Metrics[3]},
+	}}
+	s.conf.Store(conf)
+
+	families := map[string]*dto.MetricFamily{}
+	for _, c := range []prometheus.Collector{sampleCollector{s}, stateCollector{s}} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(c)
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Gather() = %v", err)
+		}
+		for _, mf := range mfs {
+			families[mf.GetName()] = mf
+		}
+	}
+
+	testCases := []struct {
+		metric      string
+		wantSeries  int
+		wantAge     time.Duration
+		wantSuccess float64
+	}{
+		{metric: "fresh", wantSeries: 2, wantAge: 10 * time.Second, wantSuccess: 1},
+		{metric: "failing", wantSeries: 1, wantAge: 2 * time.Minute, wantSuccess: 0},
+		{metric: "stale", wantSeries: 0, wantAge: 10 * time.Minute, wantSuccess: 0},
+		{metric: "pending", wantSeries: 0, wantAge: -1, wantSuccess: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.metric, func(t *testing.T) {
+			if got := len(families[tc.metric].GetMetric()); got != tc.wantSeries {
+				t.Errorf("got %d series, want %d", got, tc.wantSeries)
+			}
+
+			age, ok := gaugeFor(families["promql_to_scrape_sample_age_seconds"], tc.metric)
+			switch {
+			case tc.wantAge < 0 && ok:
+				t.Errorf("got sample age %v for a metric never queried successfully", age)
+			case tc.wantAge >= 0 && !ok:
+				t.Error("sample age is missing")
+			case ok && (age < tc.wantAge.Seconds() || age > tc.wantAge.Seconds()+5):
+				t.Errorf("got sample age %v, want about %v", age, tc.wantAge.Seconds())
+			}
+
+			if success, _ := gaugeFor(families["promql_to_scrape_query_success"], tc.metric); success != tc.wantSuccess {
+				t.Errorf("got query success %v, want %v", success, tc.wantSuccess)
+			}
+		})
+	}
+
+	// nothing fresh to serve
+	s.metrics = map[string]*metricState{"stale": {samples: namespaceSamples("a"), lastSuccess: now.Add(-10 * time.Minute)}}
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d with only stale samples, want 500", rec.Code)
+	}
+}
+
+func TestHasFreshData(t *testing.T) {
+	if _, err := ParseConfig([]byte("min_fresh_ratio: 1.5\n")); err == nil {
+		t.Error("ParseConfig() accepted a min_fresh_ratio above 1")
+	}
+
+	now := time.Now()
+	fresh := &metricState{samples: namespaceSamples("a"), lastSuccess: now.Add(-time.Minute)}
+	stale := &metricState{samples: namespaceSamples("a"), lastSuccess: now.Add(-10 * time.Minute)}
+
+	testCases := []struct {
+		name   string
+		config string
+		states map[string]*metricState
+		want   bool
+	}{
+		{
+			name:   "no metrics configured",
+			config: "metrics: []\n",
+			want:   true,
+		},
+		{
+			name:   "nothing refreshed yet",
+			config: "metrics:\n  - {metric_name: a, query: a}\n",
+			want:   false,
+		},
+		{
+			name:   "half fresh at the default ratio",
+			config: "metrics:\n  - {metric_name: a, query: a}\n  - {metric_name: b, query: b}\n",
+			states: map[string]*metricState{"a": fresh, "b": stale},
+			want:   true,
+		},
+		{
+			name:   "mostly stale at the default ratio",
+			config: "metrics:\n  - {metric_name: a, query: a}\n  - {metric_name: b, query: b}\n  - {metric_name: c, query: c}\n",
+			states: map[string]*metricState{"a": fresh, "b": stale},
+			want:   false,
+		},
+		{
+			name:   "derived metrics count",
+			config: "metrics:\n  - {metric_name: a, query: a}\n  - {metric_name: b, query: b}\nderived_metrics:\n  - {metric_name: c, expr: a / b}\n",
+			states: map[string]*metricState{"a": fresh, "b": stale, "c": fresh},
+			want:   true,
+		},
+		{
+			name:   "every metric fresh when all are required",
+			config: "min_fresh_ratio: 1\nmetrics:\n  - {metric_name: a, query: a}\n  - {metric_name: b, query: b}\n",
+			states: map[string]*metricState{"a": fresh, "b": fresh},
+			want:   true,
+		},
+		{
+			name:   "one metric stale when all are required",
+			config: "min_fresh_ratio: 1\nmetrics:\n  - {metric_name: a, query: a}\n  - {metric_name: b, query: b}\n",
+			states: map[string]*metricState{"a": fresh, "b": stale},
+			want:   false,
+		},
+		{
+			name:   "everything stale with a ratio of 0",
+			config: "min_fresh_ratio: 0\nmetrics:\n  - {metric_name: a, query: a}\n",
+			states: map[string]*metricState{"a": stale},
+			want:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf, err := ParseConfig([]byte(tc.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &PromToScrapeServer{metrics: tc.states}
+			if got := s.hasFreshData(conf, now); got != tc.want {
+				t.Errorf("hasFreshData() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunReturnsAfterCancel(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := "query_timeout: 30s\nmetrics:\n  - metric_name: ok\n    query: ok\n  - metric_name: block\n    query: block\n"
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client := &scriptedQuerier{}
+	s, err := NewPromToScrapeServer(client, configFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPromToScrapeServer() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	// wait for the first refresh, whose blocking query only cancel can end
+	for deadline := time.Now().Add(5 * time.Second); client.inFlight.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no query was started")
+		}
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v, want nil after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after its context was canceled")
+	}
+}
+
+// perQueryQuerier counts the instant queries of another Querier by their text.
+type perQueryQuerier struct {
+	Querier
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (q *perQueryQuerier) QueryMetricsInstant(ctx context.Context, promql string, ts time.Time) (model.Vector, error) {
+	q.mu.Lock()
+	q.calls[promql]++
+	q.mu.Unlock()
+	return q.Querier.QueryMetricsInstant(ctx, promql, ts)
+}
+
+func (q *perQueryQuerier) count(promql string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.calls[promql]
+}
+
+func TestRunGroups(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+concurrency: 1
+staleness_threshold: 2h
+metrics:
+  - {metric_name: fast_a, query: slow_a, interval: 100ms, timeout: 50ms}
+  - {metric_name: fast_b, query: slow_b, interval: 100ms, timeout: 50ms}
+  - {metric_name: hourly, query: slow_h, interval: 1h}
+`
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	scripted := &scriptedQuerier{}
+	client := &perQueryQuerier{Querier: scripted, calls: map[string]int{}}
+	s, err := NewPromToScrapeServer(client, configFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPromToScrapeServer() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	time.Sleep(550 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+
+	for _, query := range []string{"slow_a", "slow_b"} {
+		if got := client.count(query); got < 3 {
+			t.Errorf("got %d queries for %s every 100ms, want at least 3", got, query)
+		}
+	}
+	if got := client.count("slow_h"); got != 1 {
+		t.Errorf("got %d queries for the hourly metric, want 1", got)
+	}
+	if got := scripted.maxInFlight.Load(); got != 1 {
+		t.Errorf("got %d queries in flight at once across groups, want at most concurrency 1", got)
+	}
+}
+
+func TestGroupRefresh(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+cycle_timeout: 30s
+metrics:
+  - {metric_name: a, query: a, interval: 10s, timeout: 5s}
+  - {metric_name: b, query: b}
+`
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewPromToScrapeServer(&scriptedQuerier{}, configFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewPromToScrapeServer() = %v", err)
+	}
+	conf := s.conf.Load()
+	groups := conf.groupBySchedule()
+	fastKey, slowKey := groupKey{interval: 10 * time.Second}, groupKey{interval: conf.Interval}
+
+	fast, slow := conf.group(fastKey, groups[fastKey]), conf.group(slowKey, groups[slowKey])
+	if fast.CycleTimeout != 10*time.Second || slow.CycleTimeout != 30*time.Second {
+		t.Errorf("got cycle timeouts %s and %s, want the interval 10s and cycle_timeout 30s", fast.CycleTimeout, slow.CycleTimeout)
+	}
+
+	before := time.Unix(1000, 0)
+	s.metrics["b"] = &metricState{metric: conf.Metrics[1], samples: namespaceSamples("x"), lastSuccess: before, lastAttempt: before}
+	s.groups[slowKey] = &groupState{lastSuccessfulRefresh: before}
+
+	s.queryMetrics(context.Background(), conf, fastKey, fast, &scriptedQuerier{})
+
+	if state := s.metrics["a"]; state == nil || state.lastSuccess.IsZero() {
+		t.Error("refreshed metric has no successful query")
+	}
+	if state := s.metrics["b"]; !state.lastSuccess.Equal(before) || !state.lastAttempt.Equal(before) {
+		t.Errorf("metric of the other group was touched: last success %s, attempt %s", state.lastSuccess, state.lastAttempt)
+	}
+	if !s.groups[slowKey].lastSuccessfulRefresh.Equal(before) {
+		t.Error("state of the other group was touched")
+	}
+	if s.groups[fastKey] == nil || s.groups[fastKey].lastSuccessfulRefresh.IsZero() {
+		t.Error("refreshed group has no successful refresh")
+	}
+}
+
+func TestMetricsEndpointDisabled(t *testing.T) {
+	if _, err := ParseConfig([]byte("disable_metrics_endpoint: true\n")); err == nil {
+		t.Error("ParseConfig() accepted disable_metrics_endpoint without a push target")
+	}
+	conf, err := ParseConfig([]byte(`
+disable_metrics_endpoint: true
+otlp:
+  endpoint: otel-collector:4317
+metrics:
+  - metric_name: a
+    query: a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &PromToScrapeServer{metrics: map[string]*metricState{
+		"a": {metric: conf.Metrics[0], samples: namespaceSamples("x"), lastSuccess: time.Now()},
+	}}
+	s.conf.Store(conf)
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", rec.Code)
+	}
+}
+
+// gaugeFor returns the value of the series of mf labeled with metricName.
+func gaugeFor(mf *dto.MetricFamily, metricName string) (float64, bool) {
+	for _, m := range mf.GetMetric() {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "metric_name" && l.GetValue() == metricName {
+				return m.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
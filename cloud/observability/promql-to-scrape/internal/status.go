@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"html/template"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slog"
+)
+
+// statusSampleSeries is how many of the series of a metric the status page shows.
+const statusSampleSeries = 5
+
+// Health of a target, as on the Prometheus targets page.
+const (
+	targetHealthUp      = "up"
+	targetHealthDown    = "down"
+	targetHealthUnknown = "unknown"
+)
+
+// targetStatus describes a configured metric on the status page and /api/v1/targets.
+type targetStatus struct {
+	MetricName string `json:"metricName"`
+	Account    string `json:"account,omitempty"`
+	Query      string `json:"query"`
+	// Interval and Offset are left out for derived metrics, computed whenever an input is.
+	Interval string `json:"interval,omitempty"`
+	Offset   string `json:"offset,omitempty"`
+	// Health is up if the last query succeeded, down if it failed and unknown before the first.
+	Health          string     `json:"health"`
+	LastError       string     `json:"lastError"`
+	LastRun         *time.Time `json:"lastRun,omitempty"`
+	LastSuccess     *time.Time `json:"lastSuccess,omitempty"`
+	LastRunDuration float64    `json:"lastRunDuration"`
+	// Series counts the series served, SampleSeries holds the first few in label order.
+	Series       int            `json:"series"`
+	SampleSeries []seriesStatus `json:"sampleSeries"`
+}
+
+// seriesStatus is one series of a metric. The value is a string, as in the Prometheus API,
+// so NaN and infinities survive JSON.
+type seriesStatus struct {
+	Labels model.Metric `json:"labels"`
+	Value  string       `json:"value"`
+}
+
+// targetsResponse follows the shape of the Prometheus /api/v1/targets response.
+type targetsResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ActiveTargets []targetStatus `json:"activeTargets"`
+	} `json:"data"`
+}
+
+// targets describes every configured metric in config order, followed by the derived ones.
+func (s *PromToScrapeServer) targets() []targetStatus {
+	conf := s.conf.Load()
+
+	s.RLock()
+	defer s.RUnlock()
+
+	metrics := slices.Clone(conf.Metrics)
+	for _, d := range conf.DerivedMetrics {
+		metrics = append(metrics, d.metric())
+	}
+	targets := make([]targetStatus, 0, len(metrics))
+	for _, metric := range metrics {
+		target := targetStatus{
+			MetricName:   metric.MetricName,
+			Account:      metric.Account,
+			Query:        metric.Query,
+			Health:       targetHealthUnknown,
+			SampleSeries: []seriesStatus{},
+		}
+		if metric.Offset != nil {
+			target.Interval = model.Duration(metric.Interval).String()
+			target.Offset = model.Duration(*metric.Offset).String()
+		}
+		state, ok := s.metrics[metric.key()]
+		if !ok || state.lastAttempt.IsZero() {
+			targets = append(targets, target)
+			continue
+		}
+
+		lastRun := state.lastAttempt
+		target.LastRun = &lastRun
+		target.LastRunDuration = state.lastDuration.Seconds()
+		target.Health = targetHealthUp
+		if state.lastError != nil {
+			target.Health = targetHealthDown
+			target.LastError = state.lastError.Error()
+		}
+		if !state.lastSuccess.IsZero() {
+			lastSuccess := state.lastSuccess
+			target.LastSuccess = &lastSuccess
+		}
+
+		target.Series = len(state.samples)
+		samples := slices.Clone(state.samples)
+		slices.SortFunc(samples, func(a, b *model.Sample) int {
+			return strings.Compare(a.Metric.String(), b.Metric.String())
+		})
+		for _, sample := range samples[:min(len(samples), statusSampleSeries)] {
+			target.SampleSeries = append(target.SampleSeries, seriesStatus{Labels: sample.Metric, Value: sample.Value.String()})
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// targetsHandler is the HTTP handler for the "/api/v1/targets" endpoint.
+func (s *PromToScrapeServer) targetsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := targetsResponse{Status: "success"}
+	resp.Data.ActiveTargets = s.targets()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// statusHandler is the HTTP handler for the "/status" page.
+func (s *PromToScrapeServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, s.targets()); err != nil {
+		slog.Error("failed to render status page", "error", err)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"since": func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return time.Since(*t).Truncate(time.Second).String() + " ago"
+	},
+	"duration": func(secs float64) string {
+		return time.Duration(secs * float64(time.Second)).Round(time.Millisecond).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>promql-to-scrape status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 0.4em; text-align: left; vertical-align: top; }
+pre { margin: 0; white-space: pre-wrap; }
+.up { color: #2a7d2a; }
+.down { color: #b22222; }
+.unknown { color: #777; }
+</style>
+</head>
+<body>
+<h1>promql-to-scrape</h1>
+<p>{{len .}} configured metrics. Also as <a href="api/v1/targets">JSON</a>, served on <a href="metrics">/metrics</a>.</p>
+<table>
+<tr><th>Metric</th><th>Account</th><th>Health</th><th>Last run</th><th>Duration</th><th>Series</th><th>Error</th></tr>
+{{range .}}
+<tr>
+<td><b>{{.MetricName}}</b> {{if .Interval}}every {{.Interval}}, {{.Offset}} ago{{else}}derived{{end}}<pre>{{.Query}}</pre>
+{{if .SampleSeries}}<details><summary>first {{len .SampleSeries}} of {{.Series}} series</summary><pre>{{range .SampleSeries}}{{.Labels}} {{.Value}}
+{{end}}</pre></details>{{end}}</td>
+<td>{{.Account}}</td>
+<td class="{{.Health}}">{{.Health}}</td>
+<td>{{since .LastRun}}</td>
+<td>{{if .LastRun}}{{duration .LastRunDuration}}{{end}}</td>
+<td>{{.Series}}</td>
+<td>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
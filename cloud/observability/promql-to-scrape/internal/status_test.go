@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestStatus(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+metrics:
+  - metric_name: ok
+    query: ok
+  - metric_name: failing
+    query: sum by (temporal_namespace) (failing{a="<b>"})
+  - metric_name: pending
+    query: pending
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	samples := namespaceSamples("g", "f", "e", "d", "c", "b", "a")
+	samples[6].Value = model.SampleValue(math.NaN())
+	s := &PromToScrapeServer{metrics: map[string]*metricState{
+		"ok":      {metric: conf.Metrics[0], samples: samples, lastSuccess: now, lastAttempt: now, lastDuration: 150 * time.Millisecond},
+		"failing": {metric: conf.Metrics[1], lastAttempt: now, lastError: errors.New("bad_data: <unexpected>")},
+	}}
+	s.conf.Store(conf)
+
+	rec := httptest.NewRecorder()
+	s.targetsHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/targets", nil))
+	var resp targetsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode targets: %v", err)
+	}
+	targets := resp.Data.ActiveTargets
+	if resp.Status != "success" || len(targets) != 3 {
+		t.Fatalf("got %+v, want the 3 configured metrics", resp)
+	}
+
+	ok := targets[0]
+	if ok.Health != targetHealthUp || ok.Series != 7 || ok.LastRunDuration != 0.15 || ok.LastRun == nil {
+		t.Errorf("got %+v for the successful metric", ok)
+	}
+	if len(ok.SampleSeries) != statusSampleSeries || ok.SampleSeries[0].Labels["temporal_namespace"] != "a" || ok.SampleSeries[0].Value != "NaN" {
+		t.Errorf("got sample series %v, want the first %d in label order", ok.SampleSeries, statusSampleSeries)
+	}
+	if failing := targets[1]; failing.Health != targetHealthDown || failing.LastError != "bad_data: <unexpected>" {
+		t.Errorf("got %+v for the failing metric", failing)
+	}
+	if pending := targets[2]; pending.Health != targetHealthUnknown || pending.LastRun != nil {
+		t.Errorf("got %+v for the metric never queried", pending)
+	}
+
+	rec = httptest.NewRecorder()
+	s.statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	page := rec.Body.String()
+	for _, want := range []string{"<b>failing</b>", `failing{a=&#34;&lt;b&gt;&#34;}`, "bad_data: &lt;unexpected&gt;", "first 5 of 7 series"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("status page is missing %q", want)
+		}
+	}
+}
@@ -1,35 +1,174 @@
 package internal
 
+// The client side of this file, with fileStamp in web.go, is kept in sync with
+// promql-to-dd-go/prometheus/tls.go, as the two exporters are separate modules that can't
+// share it. A fix to one belongs in the other.
+
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
+
+	"golang.org/x/exp/slog"
 )
 
+// BuildTLSConfig returns the client side TLS config for the Prometheus API. The client cert is
+// optional when another authentication method is used. The client key pair and server CA are
+// checked on every TLS handshake and read again if their files changed, so they can be rotated
+// without a restart. The server certificate must be valid for serverName, which
+// NewRoundTripper sets to the endpoint host unless one is configured.
 func BuildTLSConfig(clientCert, clientKey, serverRootCACert, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	files := &clientTLS{certFile: clientCert, keyFile: clientKey, caFile: serverRootCACert, serverName: serverName}
+	if _, _, err := files.load(); err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if clientCert != "" {
+		tlsConf.GetClientCertificate = files.getClientCertificate
+	}
+	if serverRootCACert != "" && !insecureSkipVerify {
+		// RootCAs can't change after the config is in use, so the chain is verified by
+		// verifyConnection against the current pool instead.
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyConnection = files.verifyConnection
+	}
+	return tlsConf, nil
+}
+
+// clientTLS holds the client key pair and server CA pool for the Prometheus API, reloading
+// them on the next handshake after one of their files changed. Files are compared by a stat
+// rather than watched: connections are kept alive, so handshakes are rare, and a watcher would
+// need stopping when a reload drops the client.
+type clientTLS struct {
+	certFile, keyFile, caFile string
+	// serverName is what the server certificate is verified for.
+	serverName string
+
+	mu    sync.Mutex
+	stamp string
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+}
+
+// load returns the current key pair and CA pool, either nil if its files are not set. If the
+// files changed but fail to load, the previous ones are kept.
+func (c *clientTLS) load() (*tls.Certificate, *x509.CertPool, error) {
+	stamp := fileStamp(c.certFile, c.keyFile, c.caFile)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stamp != "" && stamp == c.stamp {
+		return c.cert, c.pool, nil
+	}
+
+	cert, pool, err := c.read()
 	if err != nil {
-		log.Fatalf("failed load key pairs: %s", err)
+		if c.stamp == "" {
+			return nil, nil, err
+		}
+		// only retried once the files change again
+		c.stamp = stamp
+		slog.Error("failed to reload client TLS files, keeping the previous ones", "error", err)
+		return c.cert, c.pool, nil
 	}
+	if c.stamp != "" {
+		slog.Info("reloaded client TLS files", "client_cert", c.certFile, "server_root_ca_cert", c.caFile)
+	}
+	c.stamp, c.cert, c.pool = stamp, cert, pool
+	return cert, pool, nil
+}
 
-	// Load server CA if given
-	var serverCAPool *x509.CertPool
-	if serverRootCACert != "" {
-		serverCAPool = x509.NewCertPool()
-		b, err := os.ReadFile(serverRootCACert)
+func (c *clientTLS) read() (*tls.Certificate, *x509.CertPool, error) {
+	var cert *tls.Certificate
+	if c.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed reading server CA: %w", err)
-		} else if !serverCAPool.AppendCertsFromPEM(b) {
-			return nil, fmt.Errorf("server CA PEM file invalid")
+			return nil, nil, fmt.Errorf("failed to load client key pair: %w", err)
 		}
+		clientCertExpiry.WithLabelValues(c.certFile).Set(float64(pair.Leaf.NotAfter.Unix()))
+		cert = &pair
 	}
 
-	return &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            serverCAPool,
-		ServerName:         serverName,
-		InsecureSkipVerify: insecureSkipVerify,
-	}, nil
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		var err error
+		if pool, err = loadCertPool(c.caFile); err != nil {
+			return nil, nil, fmt.Errorf("failed reading server CA: %w", err)
+		}
+	}
+	return cert, pool, nil
+}
+
+func (c *clientTLS) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _, err := c.load()
+	return cert, err
+}
+
+// verifyConnection verifies the server chain against the current CA pool, as crypto/tls would
+// with RootCAs set. The name is checked against serverName rather than cs.ServerName, which is
+// empty when connecting to an IP address since those are not sent over SNI.
+func (c *clientTLS) verifyConnection(cs tls.ConnectionState) error {
+	_, pool, err := c.load()
+	if err != nil {
+		return err
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	name := c.serverName
+	if name == "" {
+		name = cs.ServerName
+	}
+	if name == "" {
+		return errors.New("no server name to verify the server certificate for")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// loadCertPool reads a pool of CA certificates from a PEM file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s holds no valid PEM certificate", file)
+	}
+	return pool, nil
+}
+
+// buildServerTLSConfig returns the TLS config of the listener for conf.
+func buildServerTLSConfig(conf *ListenerTLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server key pair: %w", err)
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if conf.ClientCAFile != "" {
+		if tlsConf.ClientCAs, err = loadCertPool(conf.ClientCAFile); err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %w", err)
+		}
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
 }
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBuildTLSConfigRotation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, caFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "ca.crt")
+
+	ca, caKey := newTestCert(t, nil, nil, "ca")
+	writePEM(t, caFile, ca, nil)
+	client, clientKey := newTestCert(t, ca, caKey, "client-1")
+	writePEM(t, certFile, client, clientKey)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName)) //nolint:errcheck // test server
+	}))
+	server, serverKey := newTestCert(t, ca, caKey, "server")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tlsConf, err := BuildTLSConfig(certFile, certFile, caFile, "localhost", false)
+	if err != nil {
+		t.Fatalf("BuildTLSConfig() = %v", err)
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf, DisableKeepAlives: true}}
+	get := func() string {
+		t.Helper()
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b := make([]byte, 64)
+		n, _ := resp.Body.Read(b)
+		return string(b[:n])
+	}
+
+	if got := get(); got != "client-1" {
+		t.Errorf("server saw client %q, want client-1", got)
+	}
+	if got := testutil.ToFloat64(clientCertExpiry.WithLabelValues(certFile)); got != float64(client.NotAfter.Unix()) {
+		t.Errorf("got expiry %v, want %v", got, client.NotAfter.Unix())
+	}
+
+	touch := func(file string) {
+		t.Helper()
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a broken file keeps the previous key pair
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(certFile)
+	if got := get(); got != "client-1" {
+		t.Errorf("server saw client %q after a failed reload, want client-1", got)
+	}
+
+	rotated, rotatedKey := newTestCert(t, ca, caKey, "client-2")
+	writePEM(t, certFile, rotated, rotatedKey)
+	touch(certFile)
+	if got := get(); got != "client-2" {
+		t.Errorf("server saw client %q after rotation, want client-2", got)
+	}
+
+	// a CA that didn't sign the server certificate is picked up too
+	other, _ := newTestCert(t, nil, nil, "other-ca")
+	writePEM(t, caFile, other, nil)
+	touch(caFile)
+	if _, err := c.Get(srv.URL); err == nil {
+		t.Error("request succeeded after rotating to an unrelated CA")
+	}
+}
+
+func TestBuildTLSConfigMissingFiles(t *testing.T) {
+	if _, err := BuildTLSConfig("missing.crt", "missing.key", "", "", false); err == nil {
+		t.Error("BuildTLSConfig() succeeded with missing client cert files")
+	}
+}
+
+func TestVerifyServerName(t *testing.T) {
+	dir := t.TempDir()
+	certFile, caFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "ca.crt")
+	ca, caKey := newTestCert(t, nil, nil, "ca")
+	writePEM(t, caFile, ca, nil)
+	client, clientKey := newTestCert(t, ca, caKey, "client")
+	writePEM(t, certFile, client, clientKey)
+
+	// valid for localhost and 127.0.0.1
+	server, serverKey := newTestCert(t, ca, caKey, "server")
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}}}
+	srv.StartTLS()
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	testCases := []struct {
+		name       string
+		targetHost string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "endpoint IP in the SANs", targetHost: srv.URL + "/prometheus"},
+		{name: "endpoint IP missing from the SANs", targetHost: fmt.Sprintf("https://127.0.0.2:%d/prometheus", port), wantErr: true},
+		{name: "configured server name", targetHost: fmt.Sprintf("https://127.0.0.2:%d/prometheus", port), serverName: "localhost"},
+		{name: "configured server name missing from the SANs", targetHost: srv.URL, serverName: "prometheus.example.com", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt, err := NewRoundTripper(APIConfig{
+				TargetHost:       tc.targetHost,
+				ClientCert:       certFile,
+				ClientKey:        certFile,
+				ServerRootCACert: caFile,
+				ServerName:       tc.serverName,
+			})
+			if err != nil {
+				t.Fatalf("NewRoundTripper() = %v", err)
+			}
+			// always dial the test server, whatever the endpoint says
+			resp, err := (&http.Client{Transport: rt}).Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("request error = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+
+	// without a name, an IP address is not verified against anything, so it is refused
+	tlsConf, err := BuildTLSConfig("", "", caFile, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}).Get(srv.URL); err == nil || !strings.Contains(err.Error(), "no server name") {
+		t.Errorf("request without a server name to verify = %v", err)
+	}
+}
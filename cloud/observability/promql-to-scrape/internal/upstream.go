@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errCircuitOpen is returned instead of querying while the circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open after repeated upstream failures, not querying")
+
+// upstream paces the requests to a Prometheus API: a token bucket limits their rate, and a
+// circuit breaker pauses them for a while once too many in a row failed.
+type upstream struct {
+	endpoint string
+
+	mu   sync.Mutex
+	conf UpstreamConfig
+	// tokens may go negative, each missing token being a request waiting its turn.
+	tokens float64
+	last   time.Time
+	// failures counts requests failing in a row, even after retries. The breaker is open
+	// until openUntil once they reach conf.BreakerThreshold, then lets a single probe through.
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newUpstream(endpoint string, conf UpstreamConfig) *upstream {
+	u := &upstream{endpoint: endpoint}
+	u.setConfig(conf)
+	circuitBreakerOpen.WithLabelValues(endpoint).Set(0)
+	return u
+}
+
+// setConfig applies a reloaded config, keeping the state of the bucket and breaker.
+func (u *upstream) setConfig(conf UpstreamConfig) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.last.IsZero() {
+		u.tokens = float64(conf.Burst)
+	}
+	u.conf = conf
+}
+
+// allow reports whether the breaker lets a request through.
+func (u *upstream) allow(now time.Time) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failures < u.conf.BreakerThreshold {
+		return nil
+	}
+	if now.Before(u.openUntil) || u.probing {
+		return errCircuitOpen
+	}
+	u.probing = true
+	return nil
+}
+
+// done records the outcome of a request let through by allow.
+func (u *upstream) done(now time.Time, failed bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.probing = false
+	if !failed {
+		if u.failures >= u.conf.BreakerThreshold {
+			circuitBreakerOpen.WithLabelValues(u.endpoint).Set(0)
+		}
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if u.failures >= u.conf.BreakerThreshold {
+		u.openUntil = now.Add(u.conf.BreakerCooldown)
+		circuitBreakerOpen.WithLabelValues(u.endpoint).Set(1)
+	}
+}
+
+// cancel releases the probe of a request let through by allow that was never sent.
+func (u *upstream) cancel() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.probing = false
+}
+
+// wait blocks until the token bucket lets a request through, or ctx is done. A negative rate
+// limit lets every request through at once.
+func (u *upstream) wait(ctx context.Context) error {
+	u.mu.Lock()
+	if u.conf.RateLimit < 0 {
+		u.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if !u.last.IsZero() {
+		u.tokens = min(float64(u.conf.Burst), u.tokens+now.Sub(u.last).Seconds()*u.conf.RateLimit)
+	}
+	u.last = now
+	u.tokens--
+	delay := time.Duration(-u.tokens / u.conf.RateLimit * float64(time.Second))
+	u.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// give the token back to whoever waits next
+		u.mu.Lock()
+		u.tokens++
+		u.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// backoff returns the delay before retry attempt, counting from 0: exponential between
+// MinBackoff and MaxBackoff, with half of it random so clients failing together don't retry
+// together.
+func (u *upstream) backoff(attempt int) time.Duration {
+	u.mu.Lock()
+	d := u.conf.MinBackoff
+	for i := 0; i < attempt && d < u.conf.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, u.conf.MaxBackoff)
+	u.mu.Unlock()
+	return d/2 + rand.N(d/2+1)
+}
+
+func (u *upstream) maxRetries() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conf.MaxRetries
+}
+
+// retryable reports whether a request that got resp and err is worth retrying: timeouts,
+// connections reset or closed by the endpoint, and 429, 502, 503 and 504 responses. Other
+// errors, like a failed TLS verification or DNS lookup, or a 501 the Prometheus client falls
+// back to GET on, won't go away by retrying. Only retryable failures count towards the
+// circuit breaker.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return (errors.As(err, &netErr) && netErr.Timeout()) ||
+			errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter parses the Retry-After header of resp, in seconds or as an HTTP date. It returns
+// 0 if there is none.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
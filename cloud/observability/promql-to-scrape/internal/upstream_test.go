@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestHttpClient(t *testing.T, conf UpstreamConfig, handler http.HandlerFunc) (*HttpClient, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := NewHttpClient(srv.URL, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.applyDefaults()
+	c.SetUpstreamConfig(conf)
+	return c, &requests
+}
+
+func getQuery(t *testing.T, ctx context.Context, c *HttpClient) (*http.Response, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, c.URL("/api/v1/query", nil).String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err := c.Do(ctx, req)
+	return resp, err
+}
+
+func TestHttpClientRetries(t *testing.T) {
+	var fail atomic.Int32
+	fail.Store(2)
+	c, requests := newTestHttpClient(t, UpstreamConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		if fail.Add(-1) >= 0 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	resp, err := getQuery(t, context.Background(), c)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Do() = %v, %v", resp, err)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestHttpClientRetryAfterPastDeadline(t *testing.T) {
+	c, requests := newTestHttpClient(t, UpstreamConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := getQuery(t, ctx, c)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Do() = %v, %v, want the 429 back", resp, err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1 as the retry would outlive the request", got)
+	}
+}
+
+func TestHttpClientCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	c, requests := newTestHttpClient(t, UpstreamConfig{
+		MaxRetries:       1,
+		MinBackoff:       time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if resp, err := getQuery(t, ctx, c); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("Do() = %v, %v", resp, err)
+		}
+	}
+	if _, err := getQuery(t, ctx, c); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Do() = %v with the breaker open, want errCircuitOpen", err)
+	}
+	if got := requests.Load(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	healthy.Store(true)
+	for i := 0; i < 2; i++ {
+		if resp, err := getQuery(t, ctx, c); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Do() = %v, %v after the cooldown", resp, err)
+		}
+	}
+}
+
+func TestHttpClientRateLimit(t *testing.T) {
+	c, _ := newTestHttpClient(t, UpstreamConfig{RateLimit: 20, Burst: 1}, func(w http.ResponseWriter, r *http.Request) {})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := getQuery(t, context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 requests at 20/s with a burst of 1 took %s, want at least 100ms", elapsed)
+	}
+}
+
+func TestHttpClientClientErrors(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusInternalServerError, http.StatusNotImplemented} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			c, requests := newTestHttpClient(t, UpstreamConfig{
+				MinBackoff:       time.Millisecond,
+				MaxBackoff:       time.Millisecond,
+				BreakerThreshold: 2,
+				BreakerCooldown:  time.Hour,
+			}, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+			})
+
+			for i := 0; i < 3; i++ {
+				if resp, err := getQuery(t, context.Background(), c); err != nil || resp.StatusCode != code {
+					t.Fatalf("Do() = %v, %v, want the %d back", resp, err, code)
+				}
+			}
+			if got := requests.Load(); got != 3 {
+				t.Errorf("got %d requests, want 3 without retries or an open breaker", got)
+			}
+		})
+	}
+}
+
+func TestHttpClientNoRateLimit(t *testing.T) {
+	if _, err := ParseConfig([]byte("upstream:\n  rate_limit: -1\n")); err != nil {
+		t.Fatalf("ParseConfig() of a negative rate_limit = %v", err)
+	}
+	c, _ := newTestHttpClient(t, UpstreamConfig{RateLimit: -1, Burst: 1}, func(w http.ResponseWriter, r *http.Request) {})
+
+	// 1.9s at the default 10/s
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if _, err := getQuery(t, context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("20 requests without a rate limit took %s", elapsed)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	testCases := []struct {
+		name string
+		code int
+		err  error
+		want bool
+	}{
+		{name: "timeout", err: fmt.Errorf("Post: %w", timeout), want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: true},
+		{name: "connection closed", err: fmt.Errorf("Post: %w", io.EOF), want: true},
+		{name: "DNS failure", err: &net.DNSError{Err: "no such host", IsNotFound: true}, want: false},
+		{name: "TLS verification", err: &tls.CertificateVerificationError{Err: errors.New("unknown authority")}, want: false},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "too many requests", code: http.StatusTooManyRequests, want: true},
+		{name: "bad gateway", code: http.StatusBadGateway, want: true},
+		{name: "unavailable", code: http.StatusServiceUnavailable, want: true},
+		{name: "gateway timeout", code: http.StatusGatewayTimeout, want: true},
+		{name: "internal error", code: http.StatusInternalServerError, want: false},
+		{name: "not implemented", code: http.StatusNotImplemented, want: false},
+		{name: "bad request", code: http.StatusBadRequest, want: false},
+	}
+	for _, tc := range testCases {
+		var resp *http.Response
+		if tc.err == nil {
+			resp = &http.Response{StatusCode: tc.code}
+		}
+		if got := retryable(resp, tc.err); got != tc.want {
+			t.Errorf("%s: retryable() = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-1", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, tc := range testCases {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("Retry-After", tc.header)
+		}
+		if got := retryAfter(resp, now); got != tc.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", tc.header, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// QueryCheck is the outcome of checking the query of one metric.
+type QueryCheck struct {
+	Metric Metric
+	// Err is set if the query is not valid PromQL returning an instant vector, or failed to run.
+	Err error
+	// Executed is set if the query was run, Series and Duration then hold how many series it
+	// returned after relabeling and how long it took.
+	Executed bool
+	Series   int
+	Duration time.Duration
+}
+
+// CheckQueries parses the query of every metric of conf with the PromQL parser and, if execute
+// is set, runs the valid ones once against the endpoint of their account, at most
+// conf.Concurrency at a time. The checks are returned in the order of conf.Metrics.
+func CheckQueries(ctx context.Context, conf *Config, clients *Clients, execute bool) []QueryCheck {
+	checks := make([]QueryCheck, len(conf.Metrics))
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, conf.Concurrency)
+	)
+	for i, metric := range conf.Metrics {
+		checks[i] = QueryCheck{Metric: metric, Err: parseQuery(metric.Query)}
+		if checks[i].Err != nil || !execute {
+			continue
+		}
+
+		wg.Add(1)
+		go func(check *QueryCheck) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			runCheck(ctx, conf, clients, check)
+		}(&checks[i])
+	}
+	wg.Wait()
+	return checks
+}
+
+// parseQuery makes sure query is valid PromQL returning an instant vector, the only result
+// type served.
+func parseQuery(query string) error {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return fmt.Errorf("invalid PromQL: %w", err)
+	}
+	if t := expr.Type(); t != parser.ValueTypeVector {
+		return fmt.Errorf("query returns a %s, not an instant vector", t)
+	}
+	return nil
+}
+
+func runCheck(ctx context.Context, conf *Config, clients *Clients, check *QueryCheck) {
+	client, err := clients.get(conf, check.Metric.Account)
+	if err != nil {
+		check.Err = err
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, check.Metric.Timeout)
+	defer cancel()
+	start := time.Now()
+	result, err := client.QueryMetricsInstant(ctx, check.Metric.Query, start.Add(-*check.Metric.Offset))
+	check.Duration = time.Since(start)
+	if err != nil {
+		check.Err = err
+		return
+	}
+	check.Executed = true
+	check.Series = len(relabelSamples(result, slices.Concat(conf.RelabelConfigs, check.Metric.RelabelConfigs)))
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// instantQuerier answers instant queries from results, keyed by query.
+type instantQuerier struct {
+	Querier
+	results map[string]model.Vector
+}
+
+func (q instantQuerier) QueryMetricsInstant(_ context.Context, promql string, _ time.Time) (model.Vector, error) {
+	result, ok := q.results[promql]
+	if !ok {
+		return nil, errors.New("bad_data: unknown query")
+	}
+	return result, nil
+}
+
+func TestCheckQueries(t *testing.T) {
+	conf, err := ParseConfig([]byte(`
+metrics:
+  - metric_name: ok
+    query: rate(temporal_cloud_v0_poll_success_count[1m])
+  - metric_name: empty
+    query: temporal_cloud_v0_state_transitions
+  - metric_name: syntax_error
+    query: rate(temporal_cloud_v0_poll_success_count[1m]
+  - metric_name: scalar
+    query: scalar(temporal_cloud_v0_state_transitions)
+  - metric_name: failing
+    query: temporal_cloud_v0_unknown
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := instantQuerier{results: map[string]model.Vector{
+		"rate(temporal_cloud_v0_poll_success_count[1m])": {{Metric: model.Metric{"temporal_namespace": "a"}}, {Metric: model.Metric{"temporal_namespace": "b"}}},
+		"temporal_cloud_v0_state_transitions":            {},
+	}}
+
+	testCases := []struct {
+		name    string
+		execute bool
+		// want is the expected series count per metric, or the start of its error.
+		want map[string]any
+	}{
+		{
+			name: "parse only",
+			want: map[string]any{
+				"ok":           0,
+				"empty":        0,
+				"syntax_error": "invalid PromQL",
+				"scalar":       "query returns a scalar",
+				"failing":      0,
+			},
+		},
+		{
+			name:    "execute",
+			execute: true,
+			want: map[string]any{
+				"ok":           2,
+				"empty":        0,
+				"syntax_error": "invalid PromQL",
+				"scalar":       "query returns a scalar",
+				"failing":      "bad_data",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checks := CheckQueries(context.Background(), conf, NewClients(client), tc.execute)
+			if len(checks) != len(conf.Metrics) {
+				t.Fatalf("got %d checks, want %d", len(checks), len(conf.Metrics))
+			}
+			for i, check := range checks {
+				name := conf.Metrics[i].MetricName
+				if check.Metric.MetricName != name {
+					t.Errorf("check %d is for %s, want %s", i, check.Metric.MetricName, name)
+				}
+				switch want := tc.want[name].(type) {
+				case string:
+					if check.Err == nil || !strings.HasPrefix(check.Err.Error(), want) {
+						t.Errorf("%s: got error %v, want %q", name, check.Err, want)
+					}
+				case int:
+					if check.Err != nil {
+						t.Errorf("%s: unexpected error %v", name, check.Err)
+					}
+					if check.Executed != tc.execute || check.Series != want {
+						t.Errorf("%s: got executed %t with %d series, want %t with %d", name, check.Executed, check.Series, tc.execute, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+// listenerTLS hands out the TLS config of the listener, rebuilding it whenever the config or
+// one of the files it points at changes, so certificates can be rotated without a restart.
+type listenerTLS struct {
+	conf func() *ListenerTLSConfig
+
+	mu      sync.Mutex
+	stamp   string
+	tlsConf *tls.Config
+}
+
+func (l *listenerTLS) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	conf := l.conf()
+	if conf == nil {
+		return nil, errors.New("tls is no longer configured")
+	}
+	return l.get(conf)
+}
+
+// get returns the TLS config for conf. If its files changed but fail to load, the previous
+// config is kept.
+func (l *listenerTLS) get(conf *ListenerTLSConfig) (*tls.Config, error) {
+	stamp := fileStamp(conf.CertFile, conf.KeyFile, conf.ClientCAFile)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tlsConf != nil && stamp == l.stamp {
+		return l.tlsConf, nil
+	}
+
+	tlsConf, err := buildServerTLSConfig(conf)
+	if err != nil {
+		if l.tlsConf == nil {
+			return nil, err
+		}
+		// only retried once the files change again
+		l.stamp = stamp
+		slog.Error("failed to reload listener TLS files, keeping the previous ones", "error", err)
+		return l.tlsConf, nil
+	}
+	if l.tlsConf != nil {
+		slog.Info("reloaded listener TLS files", "cert_file", conf.CertFile)
+	}
+	l.stamp, l.tlsConf = stamp, tlsConf
+	return tlsConf, nil
+}
+
+// fileStamp identifies the current content of files by their names, sizes and modification
+// times. Symlinks are followed, so Kubernetes Secret updates change it too.
+func fileStamp(files ...string) string {
+	var b strings.Builder
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		b.WriteString(file)
+		if fi, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&b, "@%d/%d", fi.ModTime().UnixNano(), fi.Size())
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// checkWeb makes sure the listener as it was started can serve with the web settings of conf.
+func (s *PromToScrapeServer) checkWeb(conf *Config) error {
+	if (conf.Web.TLS != nil) != (s.server.TLSConfig != nil) {
+		return errors.New("turning web tls on or off takes a restart")
+	}
+	if conf.Web.TLS != nil {
+		if _, err := buildServerTLSConfig(conf.Web.TLS); err != nil {
+			return err
+		}
+	}
+	if b := conf.Web.BasicAuth; b != nil {
+		if _, err := readSecret(b.Password, b.PasswordFile); err != nil {
+			return fmt.Errorf("failed to read basic_auth password: %w", err)
+		}
+	}
+	if conf.Web.BearerToken != "" || conf.Web.BearerTokenFile != "" {
+		if _, err := readSecret(conf.Web.BearerToken, conf.Web.BearerTokenFile); err != nil {
+			return fmt.Errorf("failed to read bearer token: %w", err)
+		}
+	}
+	return nil
+}
+
+// authenticate lets requests through to next if they carry credentials accepted by the
+// current web config, or if it has none. Health checks are always let through for probes.
+func (s *PromToScrapeServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		web := s.conf.Load().Web
+		ok, err := web.authorized(r)
+		if err != nil {
+			slog.Error("failed to check credentials", "error", err)
+			http.Error(w, "failed to check credentials", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			if web.BasicAuth != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="promql-to-scrape"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized reports whether r carries credentials accepted by w. Secrets are read from their
+// files on every request, so they can be rotated without a reload.
+func (w WebConfig) authorized(r *http.Request) (bool, error) {
+	hasBearer := w.BearerToken != "" || w.BearerTokenFile != ""
+	if w.BasicAuth == nil && !hasBearer {
+		return true, nil
+	}
+
+	if b := w.BasicAuth; b != nil {
+		if user, pass, ok := r.BasicAuth(); ok {
+			want, err := readSecret(b.Password, b.PasswordFile)
+			if err != nil {
+				return false, err
+			}
+			// both compared so the time taken tells nothing about which one was wrong
+			userOK := secretEqual(user, b.Username)
+			if passOK := secretEqual(pass, want); userOK && passOK {
+				return true, nil
+			}
+		}
+	}
+	if hasBearer {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			want, err := readSecret(w.BearerToken, w.BearerTokenFile)
+			if err != nil {
+				return false, err
+			}
+			if secretEqual(token, want) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// readSecret returns value, or the content of file without surrounding whitespace if set.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return secret, nil
+}
+
+// secretEqual compares in constant time, hashing first so the length is not leaked either.
+func secretEqual(got, want string) bool {
+	g, w := sha256.Sum256([]byte(got)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(g[:], w[:]) == 1
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &PromToScrapeServer{}
+	s.conf.Store(&Config{Web: WebConfig{
+		BasicAuth:       &BasicAuth{Username: "prometheus", Password: "hunter2"},
+		BearerTokenFile: tokenFile,
+	}})
+	handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	testCases := []struct {
+		name     string
+		path     string
+		setAuth  func(r *http.Request)
+		wantCode int
+	}{
+		{
+			name:     "no credentials",
+			path:     "/metrics",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "basic auth",
+			path:     "/metrics",
+			setAuth:  func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter2") },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "wrong password",
+			path:     "/metrics",
+			setAuth:  func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter3") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "bearer token from file",
+			path:     "/-/reload",
+			setAuth:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret-token") },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "wrong bearer token",
+			path:     "/internal/metrics",
+			setAuth:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "health checks stay open",
+			path:     "/readyz",
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.setAuth != nil {
+				tc.setAuth(r)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestListenerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, nil, nil, "ca")
+	writePEM(t, filepath.Join(dir, "ca.crt"), ca, nil)
+	server, serverKey := newTestCert(t, ca, caKey, "server-1")
+	writePEM(t, filepath.Join(dir, "server.crt"), server, serverKey)
+	client, clientKey := newTestCert(t, ca, caKey, "client")
+
+	conf := &ListenerTLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.crt"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	l := &listenerTLS{conf: func() *ListenerTLSConfig { return conf }}
+	if _, err := l.get(conf); err != nil {
+		t.Fatalf("get() = %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{GetConfigForClient: l.getConfigForClient}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	get := func(certs []tls.Certificate) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs, ServerName: "localhost"},
+			DisableKeepAlives: true,
+		}}
+		return c.Get(srv.URL)
+	}
+
+	if _, err := get(nil); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+	clientCert := []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}}
+	resp, err := get(clientCert)
+	if err != nil {
+		t.Fatalf("request with a client certificate failed: %v", err)
+	}
+	if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "server-1" {
+		t.Errorf("got server certificate %q, want server-1", got)
+	}
+
+	// rotate the server certificate
+	rotated, rotatedKey := newTestCert(t, ca, caKey, "server-2")
+	writePEM(t, filepath.Join(dir, "server.crt"), rotated, rotatedKey)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(conf.CertFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = get(clientCert)
+	if err != nil {
+		t.Fatalf("request after rotation failed: %v", err)
+	}
+	if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "server-2" {
+		t.Errorf("got server certificate %q after rotation, want server-2", got)
+	}
+}
+
+// newTestCert returns a certificate for cn valid for localhost, signed by parent or self-signed
+// as a CA if parent is nil.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes cert, followed by key if set, to file.
+func writePEM(t *testing.T, file string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	t.Helper()
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if key != nil {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	}
+	if err := os.WriteFile(file, out, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}